@@ -17,6 +17,7 @@ import (
 // 例子：现在需要实现一个告警模块，可以根据输入的告警规则来决定是否触发告警
 // 		告警规则支持 &&、>、< 3种运算符
 // 		其中 >、< 优先级比  && 更高
+// 		另外支持 true、false 两个常量，优化器折叠后的规则格式化之后可以重新解析
 
 // IExpression 表达式接口
 type IExpression interface {
@@ -37,6 +38,11 @@ func (r AlertRule) Interpret(stats map[string]float64) bool {
 	return r.expression.Interpret(stats)
 }
 
+// Expression 规则的语法树，可以用 visitor 包遍历和改写
+func (r AlertRule) Expression() IExpression {
+	return r.expression
+}
+
 // GreaterExpression > 表达式
 type GreaterExpression struct {
 	key   string
@@ -51,6 +57,19 @@ func (e *GreaterExpression) Interpret(stats map[string]float64) bool {
 	return v > e.value
 }
 
+// Greater 直接构造 > 表达式，不需要解析字符串
+func Greater(key string, value float64) *GreaterExpression {
+	return &GreaterExpression{key: key, value: value}
+}
+
+func (e *GreaterExpression) Key() string {
+	return e.key
+}
+
+func (e *GreaterExpression) Value() float64 {
+	return e.value
+}
+
 func NewGreaterExpression(exp string) (*GreaterExpression, error) {
 	data := regexp.MustCompile(`\s+`).Split(strings.TrimSpace(exp), -1)
 	if len(data) != 3 || data[1] != ">" {
@@ -80,6 +99,19 @@ func (e LessExpression) Interpret(stats map[string]float64) bool {
 	return v < e.value
 }
 
+// Less 直接构造 < 表达式，不需要解析字符串
+func Less(key string, value float64) *LessExpression {
+	return &LessExpression{key: key, value: value}
+}
+
+func (e LessExpression) Key() string {
+	return e.key
+}
+
+func (e LessExpression) Value() float64 {
+	return e.value
+}
+
 func NewLessExpression(exp string) (*LessExpression, error) {
 	data := regexp.MustCompile(`\s+`).Split(strings.TrimSpace(exp), -1)
 	if len(data) != 3 || data[1] != "<" {
@@ -108,6 +140,16 @@ func (e AndExpression) Interpret(stats map[string]float64) bool {
 	return true
 }
 
+// And 直接构造 && 表达式，不需要解析字符串
+func And(expressions ...IExpression) *AndExpression {
+	return &AndExpression{expressions: expressions}
+}
+
+// Expressions 所有子表达式
+func (e AndExpression) Expressions() []IExpression {
+	return append([]IExpression(nil), e.expressions...)
+}
+
 func NewAndExpression(exp string) (*AndExpression, error) {
 	exps := strings.Split(exp, "&&")
 	expressions := make([]IExpression, len(exps))
@@ -117,6 +159,8 @@ func NewAndExpression(exp string) (*AndExpression, error) {
 		var err error
 
 		switch {
+		case strings.TrimSpace(e) == "true" || strings.TrimSpace(e) == "false":
+			expression, err = NewConstExpression(e)
 		case strings.Contains(e, ">"):
 			expression, err = NewGreaterExpression(e)
 		case strings.Contains(e, "<"):
@@ -133,6 +177,31 @@ func NewAndExpression(exp string) (*AndExpression, error) {
 	return &AndExpression{expressions: expressions}, nil
 }
 
+// ConstExpression 常量表达式，一般由优化器在改写时生成
+type ConstExpression struct {
+	value bool
+}
+
+func Const(value bool) *ConstExpression {
+	return &ConstExpression{value: value}
+}
+
+func NewConstExpression(exp string) (*ConstExpression, error) {
+	value, err := strconv.ParseBool(strings.TrimSpace(exp))
+	if err != nil {
+		return nil, fmt.Errorf("exp is invalid:%s", exp)
+	}
+	return &ConstExpression{value: value}, nil
+}
+
+func (e ConstExpression) Interpret(stats map[string]float64) bool {
+	return e.value
+}
+
+func (e ConstExpression) Value() bool {
+	return e.value
+}
+
 func TestAlertRule_Interpret(t *testing.T) {
 	stats := map[string]float64{
 		"a": 1,
@@ -0,0 +1,390 @@
+package mediator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 聊天室
+// 中介模式最经典的例子：参与者加入房间之后，所有消息都通过 Chat 转发，参与者之间互不引用
+// 每个房间只保留最近的若干条消息，私聊消息不进入历史记录
+// Chat 是并发安全的，Receive 在锁外调用，同一个参与者可能被并发调用，需要自己保证并发安全
+
+var (
+	// ErrNotMember 不在房间中
+	ErrNotMember = errors.New("not a member of the room")
+	// ErrAlreadyJoined 已经在房间中
+	ErrAlreadyJoined = errors.New("already joined the room")
+)
+
+// MessageKind 消息类型
+type MessageKind string
+
+const (
+	KindText  MessageKind = "text"
+	KindJoin  MessageKind = "join"
+	KindLeave MessageKind = "leave"
+)
+
+// ChatMessage 聊天消息
+type ChatMessage struct {
+	ID   uint64
+	Kind MessageKind
+	Room string
+	From string
+	// To 私聊的接收者，为空表示发给房间里的所有人
+	To   string
+	Text string
+	Time time.Time
+}
+
+// Participant 参与者
+type Participant interface {
+	Name() string
+	Receive(msg ChatMessage)
+}
+
+// ChatOption 聊天室的可选参数
+type ChatOption struct {
+	historyLimit int
+	now          func() time.Time
+}
+
+type ChatOptFun func(option *ChatOption)
+
+// WithHistoryLimit 每个房间保留的消息数量，默认 100 条
+func WithHistoryLimit(n int) ChatOptFun {
+	return func(option *ChatOption) {
+		option.historyLimit = n
+	}
+}
+
+// WithChatClock 替换时钟，用于测试
+func WithChatClock(now func() time.Time) ChatOptFun {
+	return func(option *ChatOption) {
+		option.now = now
+	}
+}
+
+type room struct {
+	members map[string]Participant
+	// history 环形缓冲区，start 是最早一条消息的位置
+	history []ChatMessage
+	start   int
+}
+
+func (r *room) record(msg ChatMessage, limit int) {
+	if limit <= 0 {
+		return
+	}
+	if len(r.history) < limit {
+		r.history = append(r.history, msg)
+		return
+	}
+	r.history[r.start] = msg
+	r.start = (r.start + 1) % limit
+}
+
+// Chat 聊天室中介
+type Chat struct {
+	lock   sync.RWMutex
+	option ChatOption
+	rooms  map[string]*room
+	seq    uint64
+}
+
+func NewChat(opts ...ChatOptFun) *Chat {
+	option := ChatOption{historyLimit: 100, now: time.Now}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	return &Chat{option: option, rooms: map[string]*room{}}
+}
+
+// Join 加入房间，房间不存在时创建，房间里的其他人会收到加入通知
+func (c *Chat) Join(name string, p Participant) error {
+	c.lock.Lock()
+	r, ok := c.rooms[name]
+	if !ok {
+		r = &room{members: map[string]Participant{}}
+		c.rooms[name] = r
+	}
+	if _, ok := r.members[p.Name()]; ok {
+		c.lock.Unlock()
+		return fmt.Errorf("%w: %s in %s", ErrAlreadyJoined, p.Name(), name)
+	}
+	msg, recipients := c.publish(r, ChatMessage{Kind: KindJoin, Room: name, From: p.Name()})
+	r.members[p.Name()] = p
+	c.lock.Unlock()
+
+	deliver(msg, recipients)
+	return nil
+}
+
+// Leave 离开房间，最后一个人离开时删除房间
+func (c *Chat) Leave(name string, participant string) error {
+	c.lock.Lock()
+	r, err := c.member(name, participant)
+	if err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	delete(r.members, participant)
+	if len(r.members) == 0 {
+		delete(c.rooms, name)
+	}
+	msg, recipients := c.publish(r, ChatMessage{Kind: KindLeave, Room: name, From: participant})
+	c.lock.Unlock()
+
+	deliver(msg, recipients)
+	return nil
+}
+
+// Broadcast 发给房间里除自己以外的所有人
+func (c *Chat) Broadcast(name string, from string, text string) error {
+	c.lock.Lock()
+	r, err := c.member(name, from)
+	if err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	msg, recipients := c.publish(r, ChatMessage{Kind: KindText, Room: name, From: from, Text: text})
+	c.lock.Unlock()
+
+	deliver(msg, recipients)
+	return nil
+}
+
+// Direct 私聊，双方都必须在房间中
+func (c *Chat) Direct(name string, from string, to string, text string) error {
+	c.lock.Lock()
+	r, err := c.member(name, from)
+	if err != nil {
+		c.lock.Unlock()
+		return err
+	}
+	recipient, ok := r.members[to]
+	if !ok {
+		c.lock.Unlock()
+		return fmt.Errorf("%w: %s in %s", ErrNotMember, to, name)
+	}
+	c.seq++
+	msg := ChatMessage{ID: c.seq, Kind: KindText, Room: name, From: from, To: to, Text: text, Time: c.option.now()}
+	c.lock.Unlock()
+
+	recipient.Receive(msg)
+	return nil
+}
+
+// Members 房间里的参与者，按名字排序
+func (c *Chat) Members(name string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	r, ok := c.rooms[name]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(r.members))
+	for n := range r.members {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rooms 参与者所在的房间，按名字排序
+func (c *Chat) Rooms(participant string) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var names []string
+	for name, r := range c.rooms {
+		if _, ok := r.members[participant]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// History 房间最近的消息，从早到晚排列
+func (c *Chat) History(name string) []ChatMessage {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	r, ok := c.rooms[name]
+	if !ok {
+		return nil
+	}
+	history := make([]ChatMessage, 0, len(r.history))
+	history = append(history, r.history[r.start:]...)
+	return append(history, r.history[:r.start]...)
+}
+
+func (c *Chat) member(name string, participant string) (*room, error) {
+	r, ok := c.rooms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s in %s", ErrNotMember, participant, name)
+	}
+	if _, ok := r.members[participant]; !ok {
+		return nil, fmt.Errorf("%w: %s in %s", ErrNotMember, participant, name)
+	}
+	return r, nil
+}
+
+// publish 分配消息 ID，写入历史记录，返回除发送者以外的接收者，需要持有锁
+func (c *Chat) publish(r *room, msg ChatMessage) (ChatMessage, []Participant) {
+	c.seq++
+	msg.ID = c.seq
+	msg.Time = c.option.now()
+	r.record(msg, c.option.historyLimit)
+
+	recipients := make([]Participant, 0, len(r.members))
+	for name, p := range r.members {
+		if name != msg.From {
+			recipients = append(recipients, p)
+		}
+	}
+	return msg, recipients
+}
+
+func deliver(msg ChatMessage, recipients []Participant) {
+	for _, p := range recipients {
+		p.Receive(msg)
+	}
+}
+
+// Member 收集消息的参与者，只引用中介，不引用其他参与者
+type Member struct {
+	name  string
+	chat  *Chat
+	lock  sync.Mutex
+	inbox []ChatMessage
+}
+
+func NewMember(name string, chat *Chat) *Member {
+	return &Member{name: name, chat: chat}
+}
+
+func (m *Member) Name() string {
+	return m.name
+}
+
+func (m *Member) Receive(msg ChatMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.inbox = append(m.inbox, msg)
+}
+
+// Inbox 收到的消息
+func (m *Member) Inbox() []ChatMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]ChatMessage(nil), m.inbox...)
+}
+
+func (m *Member) Join(room string) error {
+	return m.chat.Join(room, m)
+}
+
+func (m *Member) Leave(room string) error {
+	return m.chat.Leave(room, m.name)
+}
+
+func (m *Member) Say(room string, text string) error {
+	return m.chat.Broadcast(room, m.name, text)
+}
+
+func (m *Member) Whisper(room string, to string, text string) error {
+	return m.chat.Direct(room, m.name, to, text)
+}
+
+func TestChat(t *testing.T) {
+	chat := NewChat(WithHistoryLimit(3))
+	alice, bob, carol := NewMember("alice", chat), NewMember("bob", chat), NewMember("carol", chat)
+
+	require.NoError(t, alice.Join("golang"))
+	require.NoError(t, bob.Join("golang"))
+	require.NoError(t, carol.Join("rust"))
+	assert.True(t, errors.Is(bob.Join("golang"), ErrAlreadyJoined))
+	assert.Equal(t, []string{"alice", "bob"}, chat.Members("golang"))
+	assert.Equal(t, []string{"rust"}, chat.Rooms("carol"))
+
+	require.NoError(t, alice.Say("golang", "hello"))
+	require.NoError(t, bob.Whisper("golang", "alice", "hi alice"))
+	// 不在房间里不能发消息，也不能私聊房间外的人
+	assert.True(t, errors.Is(carol.Say("golang", "hello"), ErrNotMember))
+	assert.True(t, errors.Is(alice.Whisper("golang", "carol", "hi"), ErrNotMember))
+
+	inbox := alice.Inbox()
+	require.Len(t, inbox, 2)
+	assert.Equal(t, KindJoin, inbox[0].Kind)
+	assert.Equal(t, "bob", inbox[0].From)
+	assert.Equal(t, "hi alice", inbox[1].Text)
+	assert.Equal(t, "alice", inbox[1].To)
+	inbox = bob.Inbox()
+	require.Len(t, inbox, 1)
+	assert.Equal(t, "hello", inbox[0].Text)
+	assert.Empty(t, carol.Inbox())
+
+	// 历史记录只保留最近 3 条，不包括私聊
+	require.NoError(t, bob.Say("golang", "how are you"))
+	require.NoError(t, bob.Leave("golang"))
+	var texts []string
+	for _, msg := range chat.History("golang") {
+		texts = append(texts, string(msg.Kind)+":"+msg.Text)
+	}
+	assert.Equal(t, []string{"text:hello", "text:how are you", "leave:"}, texts)
+	assert.Equal(t, KindLeave, alice.Inbox()[3].Kind)
+
+	require.NoError(t, alice.Leave("golang"))
+	assert.Nil(t, chat.Members("golang"))
+	assert.Nil(t, chat.History("golang"))
+}
+
+func TestChat_Concurrent(t *testing.T) {
+	chat := NewChat(WithHistoryLimit(50))
+	members := make([]*Member, 20)
+	for i := range members {
+		members[i] = NewMember(fmt.Sprintf("m%02d", i), chat)
+		require.NoError(t, members[i].Join("lobby"))
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				assert.NoError(t, m.Say("lobby", fmt.Sprintf("%s-%d", m.Name(), i)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, m := range members {
+		// 加入之后其他人的加入通知，加上其他 19 人各 10 条消息
+		var texts int
+		for _, msg := range m.Inbox() {
+			if msg.Kind == KindText {
+				texts++
+			}
+		}
+		assert.Equal(t, 190, texts)
+		assert.Len(t, m.Inbox(), 190+len(members)-1-i)
+	}
+
+	history := chat.History("lobby")
+	require.Len(t, history, 50)
+	for i := 1; i < len(history); i++ {
+		assert.Less(t, history[i-1].ID, history[i].ID)
+	}
+}
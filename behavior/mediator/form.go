@@ -0,0 +1,332 @@
+package mediator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 表单中介
+// 组件注册到 Form，发出的事件由 Form 按照声明的规则路由，规则的动作修改组件的状态（显示、隐藏、启用、禁用、校验）
+// 所有组件的状态组成 ViewState，界面根据 ViewState 渲染，测试直接断言 ViewState
+
+var (
+	// ErrUnknownComponent 组件没有注册
+	ErrUnknownComponent = errors.New("unknown component")
+	// ErrInactive 组件被隐藏或者禁用，不响应事件
+	ErrInactive = errors.New("component is hidden or disabled")
+)
+
+// ComponentState 组件的状态
+type ComponentState struct {
+	Visible bool
+	Enabled bool
+	Value   string
+	// Error 最近一次校验的错误，校验通过时为空
+	Error string
+	// Pending 异步校验还没有完成
+	Pending bool
+}
+
+// ViewState 表单的状态
+type ViewState struct {
+	Components map[string]ComponentState
+	// Focused 获得焦点的组件 ID
+	Focused string
+	// Errors 跨字段校验的错误，key 为 CrossRule 的名字
+	Errors map[string]string
+}
+
+func (v ViewState) clone() ViewState {
+	c := ViewState{
+		Components: make(map[string]ComponentState, len(v.Components)),
+		Focused:    v.Focused,
+		Errors:     make(map[string]string, len(v.Errors)),
+	}
+	for id, state := range v.Components {
+		c.Components[id] = state
+	}
+	for name, err := range v.Errors {
+		c.Errors[name] = err
+	}
+	return c
+}
+
+// Rule 事件路由规则，事件匹配时依次执行 Actions
+type Rule struct {
+	On     EventType
+	Source string
+	// Value 事件的值等于 Value 时才匹配，为空表示不限制
+	Value string
+	// When 额外的匹配条件，为空表示不限制
+	When    func(event Event, view ViewState) bool
+	Actions []Action
+}
+
+func (r Rule) match(event Event, view ViewState) bool {
+	if r.On != event.Type || r.Source != event.Source {
+		return false
+	}
+	if r.Value != "" && r.Value != event.Value {
+		return false
+	}
+	return r.When == nil || r.When(event, view)
+}
+
+// Action 规则的动作
+type Action interface {
+	apply(f *Form, event Event)
+}
+
+type actionFunc func(f *Form, event Event)
+
+func (fn actionFunc) apply(f *Form, event Event) {
+	fn(f, event)
+}
+
+// Show 显示组件
+func Show(ids ...string) Action {
+	return actionFunc(func(f *Form, event Event) {
+		f.update(ids, func(state *ComponentState) { state.Visible = true })
+	})
+}
+
+// Hide 隐藏组件
+func Hide(ids ...string) Action {
+	return actionFunc(func(f *Form, event Event) {
+		f.update(ids, func(state *ComponentState) { state.Visible = false })
+	})
+}
+
+// Enable 启用组件
+func Enable(ids ...string) Action {
+	return actionFunc(func(f *Form, event Event) {
+		f.update(ids, func(state *ComponentState) { state.Enabled = true })
+	})
+}
+
+// Disable 禁用组件
+func Disable(ids ...string) Action {
+	return actionFunc(func(f *Form, event Event) {
+		f.update(ids, func(state *ComponentState) { state.Enabled = false })
+	})
+}
+
+// Validate 运行组件的同步校验器和相关的跨字段校验，隐藏的组件不校验，异步校验保留最近一次的结果
+func Validate(ids ...string) Action {
+	return actionFunc(func(f *Form, event Event) {
+		f.validate(ids)
+	})
+}
+
+// Do 自定义动作，可以直接修改 view
+func Do(fn func(view *ViewState, event Event)) Action {
+	return actionFunc(func(f *Form, event Event) {
+		fn(&f.view, event)
+	})
+}
+
+// ComponentOption 注册组件的可选参数
+type ComponentOption struct {
+	state      ComponentState
+	validators []func(value string) error
+	async      *asyncCheck
+}
+
+type ComponentOptFun func(option *ComponentOption)
+
+// WithHidden 初始隐藏
+func WithHidden() ComponentOptFun {
+	return func(option *ComponentOption) {
+		option.state.Visible = false
+	}
+}
+
+// WithDisabled 初始禁用
+func WithDisabled() ComponentOptFun {
+	return func(option *ComponentOption) {
+		option.state.Enabled = false
+	}
+}
+
+// WithValue 初始值
+func WithValue(value string) ComponentOptFun {
+	return func(option *ComponentOption) {
+		option.state.Value = value
+	}
+}
+
+// WithValidator 校验器，返回的错误作为组件的 Error，多个校验器按顺序执行，只保留第一个错误
+func WithValidator(check func(value string) error) ComponentOptFun {
+	return func(option *ComponentOption) {
+		option.validators = append(option.validators, check)
+	}
+}
+
+// Form 表单中介，并发安全
+type Form struct {
+	lock       sync.Mutex
+	components map[string]Component
+	fields     map[string]*field
+	rules      []Rule
+	crossRules []CrossRule
+	view       ViewState
+	// pending 进行中的异步校验
+	pending sync.WaitGroup
+}
+
+func NewForm() *Form {
+	return &Form{
+		components: map[string]Component{},
+		fields:     map[string]*field{},
+		view:       ViewState{Components: map[string]ComponentState{}, Errors: map[string]string{}},
+	}
+}
+
+// Register 注册组件，组件默认显示并启用
+func (f *Form) Register(c Component, opts ...ComponentOptFun) error {
+	option := ComponentOption{state: ComponentState{Visible: true, Enabled: true}}
+	for _, opt := range opts {
+		opt(&option)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.components[c.ID()]; ok {
+		return fmt.Errorf("component already registered: %s", c.ID())
+	}
+	f.components[c.ID()] = c
+	f.fields[c.ID()] = &field{validators: option.validators, async: option.async}
+	f.view.Components[c.ID()] = option.state
+	c.setMediator(f)
+	return nil
+}
+
+// On 添加规则，规则按照添加顺序匹配，所有匹配的规则都会执行
+func (f *Form) On(rules ...Rule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rules = append(f.rules, rules...)
+}
+
+// HandleEvent 更新组件状态，change 事件会触发该组件的校验，再按照规则路由事件
+func (f *Form) HandleEvent(event Event) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	state, ok := f.view.Components[event.Source]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownComponent, event.Source)
+	}
+	if !state.Visible || !state.Enabled {
+		return fmt.Errorf("%w: %s", ErrInactive, event.Source)
+	}
+
+	switch event.Type {
+	case EventChange:
+		state.Value = event.Value
+		f.view.Components[event.Source] = state
+		f.schedule(event.Source)
+		f.validate([]string{event.Source})
+	case EventFocus:
+		f.view.Focused = event.Source
+	}
+
+	for _, rule := range f.rules {
+		if !rule.match(event, f.view) {
+			continue
+		}
+		for _, action := range rule.Actions {
+			action.apply(f, event)
+		}
+	}
+	return nil
+}
+
+// View 当前状态的副本
+func (f *Form) View() ViewState {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.view.clone()
+}
+
+func (f *Form) update(ids []string, fn func(state *ComponentState)) {
+	for _, id := range ids {
+		state, ok := f.view.Components[id]
+		if !ok {
+			continue
+		}
+		fn(&state)
+		f.view.Components[id] = state
+	}
+}
+
+// validate 同步校验组件，并重新计算相关的跨字段校验
+func (f *Form) validate(ids []string) {
+	for _, id := range ids {
+		state, ok := f.view.Components[id]
+		if !ok {
+			continue
+		}
+		state.Error = ""
+		if state.Visible {
+			state.Error = f.fields[id].check(state.Value)
+		}
+		f.view.Components[id] = state
+	}
+	f.cross(ids)
+}
+
+func TestForm(t *testing.T) {
+	f := NewForm()
+	agree := NewSelection("agree", "yes", "no")
+	submit := NewButton("submit")
+	email := NewInput("email")
+	require.NoError(t, f.Register(agree))
+	require.NoError(t, f.Register(submit, WithDisabled()))
+	require.NoError(t, f.Register(email))
+	assert.Error(t, f.Register(NewInput("email")))
+
+	var submitted []string
+	f.On(
+		Rule{On: EventChange, Source: "agree", Value: "yes", Actions: []Action{Enable("submit")}},
+		Rule{On: EventChange, Source: "agree", Value: "no", Actions: []Action{Disable("submit")}},
+		// 邮箱是公司邮箱时隐藏同意选项
+		Rule{
+			On:     EventChange,
+			Source: "email",
+			When: func(event Event, view ViewState) bool {
+				return strings.HasSuffix(event.Value, "@example.com")
+			},
+			Actions: []Action{Hide("agree"), Enable("submit")},
+		},
+		Rule{On: EventClick, Source: "submit", Actions: []Action{Do(func(view *ViewState, event Event) {
+			submitted = append(submitted, view.Components["email"].Value)
+		})}},
+	)
+
+	// 禁用的按钮不响应点击
+	assert.True(t, errors.Is(submit.Click(), ErrInactive))
+	require.NoError(t, agree.Select("yes"))
+	assert.True(t, f.View().Components["submit"].Enabled)
+	require.NoError(t, agree.Select("no"))
+	assert.False(t, f.View().Components["submit"].Enabled)
+
+	require.NoError(t, email.SetValue("bob@example.com"))
+	view := f.View()
+	assert.False(t, view.Components["agree"].Visible)
+	assert.True(t, view.Components["submit"].Enabled)
+	require.NoError(t, submit.Click())
+	assert.Equal(t, []string{"bob@example.com"}, submitted)
+
+	// 返回的是副本
+	view.Components["submit"] = ComponentState{}
+	assert.True(t, f.View().Components["submit"].Enabled)
+
+	assert.True(t, errors.Is(f.HandleEvent(Event{Type: EventClick, Source: "unknown"}), ErrUnknownComponent))
+}
@@ -9,41 +9,129 @@
 package mediator
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"reflect"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // 假设我们现在有一个较为复杂的对话框，里面包括，登录组件，注册组件，以及选择框
 // 当选择框选择“登录”时，展示登录相关组件
 // 当选择框选择“注册”时，展示注册相关组件
+// 组件之间互不引用，只把事件发给中介，由中介按照声明的规则修改其他组件的状态
+
+// ErrNoMediator 组件还没有注册到中介
+var ErrNoMediator = errors.New("component is not registered")
+
+// EventType 事件类型
+type EventType string
+
+const (
+	EventClick  EventType = "click"
+	EventChange EventType = "change"
+	EventFocus  EventType = "focus"
+)
+
+// Event 组件发出的事件
+type Event struct {
+	Type EventType
+	// Source 发出事件的组件 ID
+	Source string
+	// Value change 事件的新值
+	Value string
+}
+
+// IMediator 中介模式接口
+type IMediator interface {
+	HandleEvent(event Event) error
+}
+
+// Component 组件
+type Component interface {
+	ID() string
+	setMediator(m IMediator)
+}
+
+// base 组件的公共部分
+type base struct {
+	id       string
+	mediator IMediator
+}
+
+func (b *base) ID() string {
+	return b.id
+}
+
+func (b *base) setMediator(m IMediator) {
+	b.mediator = m
+}
+
+func (b *base) emit(t EventType, value string) error {
+	if b.mediator == nil {
+		return fmt.Errorf("%w: %s", ErrNoMediator, b.id)
+	}
+	return b.mediator.HandleEvent(Event{Type: t, Source: b.id, Value: value})
+}
+
+// Focus 获得焦点
+func (b *base) Focus() error {
+	return b.emit(EventFocus, "")
+}
+
+// Input 输入框
+type Input struct {
+	base
+}
+
+func NewInput(id string) *Input {
+	return &Input{base{id: id}}
+}
 
-type Input string
+// SetValue 用户输入
+func (i *Input) SetValue(value string) error {
+	return i.emit(EventChange, value)
+}
 
-func (i Input) String() string {
-	return string(i)
+// Selection 选择框
+type Selection struct {
+	base
+	options []string
 }
 
-type Selection string
+func NewSelection(id string, options ...string) *Selection {
+	return &Selection{base: base{id: id}, options: options}
+}
 
-func (s Selection) Selected() string {
-	return string(s)
+// Select 选择一项，只能选择已有的选项
+func (s *Selection) Select(option string) error {
+	for _, o := range s.options {
+		if o == option {
+			return s.emit(EventChange, option)
+		}
+	}
+	return fmt.Errorf("%s has no option %q", s.id, option)
 }
 
+// Button 按钮
 type Button struct {
-	onClick func()
+	base
 }
 
-func (b *Button) SetOnClick(f func()) {
-	b.onClick = f
+func NewButton(id string) *Button {
+	return &Button{base{id: id}}
 }
 
-// IMediator 中介模式接口
-type IMediator interface {
-	HandleEvent(component interface{})
+func (b *Button) Click() error {
+	return b.emit(EventClick, "")
 }
 
+// Dialog 登录注册对话框
 type Dialog struct {
+	*Form
 	LoginButton         *Button
 	RegButton           *Button
 	Selection           *Selection
@@ -52,38 +140,135 @@ type Dialog struct {
 	RepeatPasswordInput *Input
 }
 
-func (d *Dialog) HandleEvent(component interface{}) {
-	if reflect.DeepEqual(component, d.Selection) {
-		if d.Selection.Selected() == "登录" {
-			fmt.Println("select login")
-			fmt.Printf("show: %s\n", d.UsernameInput)
-			fmt.Printf("show: %s\n", d.PasswordInput)
-		} else if d.Selection.Selected() == "注册" {
-			fmt.Println("select register")
-			fmt.Printf("show: %s\n", d.UsernameInput)
-			fmt.Printf("show: %s\n", d.PasswordInput)
-			fmt.Printf("show: %s\n", d.RepeatPasswordInput)
+// UsernameChecker 检查用户名是否已被占用
+type UsernameChecker func(ctx context.Context, username string) (bool, error)
+
+// DialogOption 对话框的可选参数
+type DialogOption struct {
+	usernameDebounce time.Duration
+}
+
+type DialogOptFun func(option *DialogOption)
+
+// WithUsernameDebounce 输入停止多久之后检查用户名，默认 300ms
+func WithUsernameDebounce(d time.Duration) DialogOptFun {
+	return func(option *DialogOption) {
+		option.usernameDebounce = d
+	}
+}
+
+func NewDialog(taken UsernameChecker, opts ...DialogOptFun) (*Dialog, error) {
+	option := DialogOption{usernameDebounce: 300 * time.Millisecond}
+	for _, opt := range opts {
+		opt(&option)
+	}
+
+	d := &Dialog{
+		Form:                NewForm(),
+		LoginButton:         NewButton("login"),
+		RegButton:           NewButton("register"),
+		Selection:           NewSelection("mode", "登录", "注册"),
+		UsernameInput:       NewInput("username"),
+		PasswordInput:       NewInput("password"),
+		RepeatPasswordInput: NewInput("repeat_password"),
+	}
+	// 只有注册时需要检查用户名是否已被占用
+	checkUsername := func(ctx context.Context, value string, view ViewState) error {
+		if view.Components["mode"].Value != "注册" {
+			return nil
+		}
+		ok, err := taken(ctx, value)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return errors.New("用户名已被占用")
+		}
+		return nil
+	}
+
+	for _, err := range []error{
+		d.Register(d.Selection, WithValue("登录")),
+		d.Register(d.UsernameInput, WithValidator(Required("不能为空")), WithAsyncValidator(checkUsername, option.usernameDebounce)),
+		d.Register(d.PasswordInput, WithValidator(Required("不能为空")), WithValidator(MinLength(6, "至少 6 个字符"))),
+		d.Register(d.RepeatPasswordInput, WithHidden(), WithValidator(Required("不能为空"))),
+		d.Register(d.LoginButton),
+		d.Register(d.RegButton, WithHidden()),
+	} {
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// ...
+	d.On(
+		Rule{On: EventChange, Source: "mode", Value: "登录", Actions: []Action{
+			Show("login"), Hide("repeat_password", "register"),
+		}},
+		Rule{On: EventChange, Source: "mode", Value: "注册", Actions: []Action{
+			Show("repeat_password", "register"), Hide("login"),
+		}},
+		Rule{On: EventClick, Source: "login", Actions: []Action{Validate("username", "password")}},
+		Rule{On: EventClick, Source: "register", Actions: []Action{Validate("username", "password", "repeat_password")}},
+	)
+	d.Cross(CrossRule{
+		Name:   "repeat_password",
+		Fields: []string{"password", "repeat_password"},
+		Check: func(view ViewState) error {
+			repeat := view.Components["repeat_password"].Value
+			if repeat != "" && repeat != view.Components["password"].Value {
+				return errors.New("两次输入的密码不一致")
+			}
+			return nil
+		},
+	})
+	return d, nil
 }
 
 func TestDemo(t *testing.T) {
-	usernameInput := Input("username input")
-	passwordInput := Input("password input")
-	repeatPwdInput := Input("repeat password input")
+	d, err := NewDialog(func(ctx context.Context, username string) (bool, error) {
+		return username == "admin", nil
+	}, WithUsernameDebounce(time.Millisecond))
+	require.NoError(t, err)
 
-	selection := Selection("登录")
-	d := &Dialog{
-		Selection:           &selection,
-		UsernameInput:       &usernameInput,
-		PasswordInput:       &passwordInput,
-		RepeatPasswordInput: &repeatPwdInput,
-	}
-	d.HandleEvent(&selection)
+	view := d.View()
+	assert.True(t, view.Components["login"].Visible)
+	assert.False(t, view.Components["repeat_password"].Visible)
+
+	require.NoError(t, d.Selection.Select("注册"))
+	view = d.View()
+	assert.Equal(t, "注册", view.Components["mode"].Value)
+	assert.True(t, view.Components["repeat_password"].Visible)
+	assert.True(t, view.Components["register"].Visible)
+	assert.False(t, view.Components["login"].Visible)
+
+	// 隐藏的按钮不响应点击
+	assert.Error(t, d.LoginButton.Click())
+
+	require.NoError(t, d.UsernameInput.Focus())
+	require.NoError(t, d.UsernameInput.SetValue("alice"))
+	require.NoError(t, d.RegButton.Click())
+	view = d.View()
+	assert.Equal(t, "username", view.Focused)
+	assert.Equal(t, "", view.Components["username"].Error)
+	assert.Equal(t, "不能为空", view.Components["password"].Error)
+	assert.Equal(t, "不能为空", view.Components["repeat_password"].Error)
+
+	// 注册时检查用户名和两次输入的密码
+	require.NoError(t, d.UsernameInput.SetValue("admin"))
+	require.NoError(t, d.PasswordInput.SetValue("secret"))
+	require.NoError(t, d.RepeatPasswordInput.SetValue("secret!"))
+	d.Wait()
+	view = d.View()
+	assert.Equal(t, "用户名已被占用", view.Components["username"].Error)
+	assert.Equal(t, "两次输入的密码不一致", view.Errors["repeat_password"])
+	assert.False(t, d.Valid())
+	require.NoError(t, d.UsernameInput.SetValue("alice"))
+	require.NoError(t, d.RepeatPasswordInput.SetValue("secret"))
+	d.Wait()
+	assert.True(t, d.Valid())
 
-	regSelection := Selection("注册")
-	d.Selection = &regSelection
-	d.HandleEvent(&regSelection)
+	require.NoError(t, d.Selection.Select("登录"))
+	assert.False(t, d.View().Components["repeat_password"].Visible)
+	assert.Error(t, d.Selection.Select("退出"))
+	assert.True(t, errors.Is(NewButton("orphan").Click(), ErrNoMediator))
 }
@@ -0,0 +1,294 @@
+package mediator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 表单校验
+// 组件的值变化时由中介触发校验，校验分为三类：
+//   同步校验 - WithValidator 注册，只看组件自己的值，例如必填、长度
+//   异步校验 - WithAsyncValidator 注册，例如检查用户名是否已被占用，输入停止 debounce 之后才执行，
+//             新的输入会取消进行中的校验，同步校验不通过时不执行
+//   跨字段校验 - Form.Cross 注册，依赖的任一字段变化时执行，例如两次输入的密码必须一致
+// 同步校验的错误优先于异步校验的错误显示在组件上，跨字段校验的错误放在 ViewState.Errors 中
+
+// AsyncValidator 异步校验器，view 是开始校验时表单状态的副本
+type AsyncValidator func(ctx context.Context, value string, view ViewState) error
+
+type asyncCheck struct {
+	check    AsyncValidator
+	debounce time.Duration
+}
+
+// WithAsyncValidator 异步校验器，每个组件只能有一个
+func WithAsyncValidator(check AsyncValidator, debounce time.Duration) ComponentOptFun {
+	return func(option *ComponentOption) {
+		option.async = &asyncCheck{check: check, debounce: debounce}
+	}
+}
+
+// Required 必填
+func Required(message string) func(value string) error {
+	return func(value string) error {
+		if value == "" {
+			return errors.New(message)
+		}
+		return nil
+	}
+}
+
+// MinLength 最少 n 个字符
+func MinLength(n int, message string) func(value string) error {
+	return func(value string) error {
+		if utf8.RuneCountInString(value) < n {
+			return errors.New(message)
+		}
+		return nil
+	}
+}
+
+// CrossRule 跨字段校验
+type CrossRule struct {
+	Name string
+	// Fields 依赖的字段，任一字段变化时校验，有字段被隐藏时不校验
+	Fields []string
+	Check  func(view ViewState) error
+}
+
+// Cross 添加跨字段校验
+func (f *Form) Cross(rules ...CrossRule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.crossRules = append(f.crossRules, rules...)
+}
+
+// Valid 校验所有显示的组件，返回表单是否有效
+// 异步校验不会重新执行，进行中的异步校验视为无效，需要等待结果时先调用 Wait
+func (f *Form) Valid() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	ids := make([]string, 0, len(f.view.Components))
+	for id := range f.view.Components {
+		ids = append(ids, id)
+	}
+	f.validate(ids)
+
+	if len(f.view.Errors) > 0 {
+		return false
+	}
+	for _, state := range f.view.Components {
+		if state.Visible && (state.Error != "" || state.Pending) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait 等待所有异步校验完成
+func (f *Form) Wait() {
+	f.pending.Wait()
+}
+
+// field 组件的校验器和异步校验的状态
+type field struct {
+	validators []func(value string) error
+	async      *asyncCheck
+	// asyncErr 最近一次异步校验的错误
+	asyncErr string
+	// cancel 取消进行中的异步校验
+	cancel func()
+}
+
+// syncCheck 同步校验，返回第一个错误
+func (fd *field) syncCheck(value string) string {
+	for _, check := range fd.validators {
+		if err := check(value); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// check 组件应该显示的错误
+func (fd *field) check(value string) string {
+	if err := fd.syncCheck(value); err != "" {
+		return err
+	}
+	return fd.asyncErr
+}
+
+// schedule 取消之前的异步校验，同步校验通过时在 debounce 之后重新校验
+func (f *Form) schedule(id string) {
+	fd := f.fields[id]
+	if fd.async == nil {
+		return
+	}
+	if fd.cancel != nil {
+		fd.cancel()
+		fd.cancel = nil
+	}
+	fd.asyncErr = ""
+
+	state := f.view.Components[id]
+	state.Pending = false
+	defer func() { f.view.Components[id] = state }()
+	if fd.syncCheck(state.Value) != "" {
+		return
+	}
+	state.Pending = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	value, view := state.Value, f.view.clone()
+	f.pending.Add(1)
+	timer := time.AfterFunc(fd.async.debounce, func() {
+		defer f.pending.Done()
+		err := fd.async.check(ctx, value, view)
+
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if ctx.Err() != nil {
+			// 已经被新的输入取代
+			return
+		}
+		cancel()
+		fd.cancel = nil
+		if err != nil {
+			fd.asyncErr = err.Error()
+		}
+		state := f.view.Components[id]
+		state.Pending = false
+		if state.Error == "" {
+			state.Error = fd.asyncErr
+		}
+		f.view.Components[id] = state
+	})
+	fd.cancel = func() {
+		cancel()
+		if timer.Stop() {
+			f.pending.Done()
+		}
+	}
+}
+
+// cross 重新计算依赖 ids 的跨字段校验
+func (f *Form) cross(ids []string) {
+	for _, rule := range f.crossRules {
+		if !dependsOn(rule, ids) {
+			continue
+		}
+		delete(f.view.Errors, rule.Name)
+		if !f.visible(rule.Fields) {
+			continue
+		}
+		if err := rule.Check(f.view.clone()); err != nil {
+			f.view.Errors[rule.Name] = err.Error()
+		}
+	}
+}
+
+func (f *Form) visible(ids []string) bool {
+	for _, id := range ids {
+		if !f.view.Components[id].Visible {
+			return false
+		}
+	}
+	return true
+}
+
+func dependsOn(rule CrossRule, ids []string) bool {
+	for _, field := range rule.Fields {
+		for _, id := range ids {
+			if field == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestForm_Validation(t *testing.T) {
+	f := NewForm()
+	username := NewInput("username")
+	password := NewInput("password")
+	repeat := NewInput("repeat_password")
+
+	var calls atomic.Int32
+	started := make(chan string, 10)
+	taken := func(ctx context.Context, value string, view ViewState) error {
+		calls.Add(1)
+		started <- value
+		if value == "slow" {
+			// 等待被新的输入取消
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		if value == "admin" {
+			return fmt.Errorf("%s 已被占用", value)
+		}
+		return nil
+	}
+	require.NoError(t, f.Register(username,
+		WithValidator(Required("请输入用户名")),
+		WithValidator(MinLength(3, "至少 3 个字符")),
+		WithAsyncValidator(taken, 20*time.Millisecond),
+	))
+	require.NoError(t, f.Register(password, WithValidator(Required("请输入密码"))))
+	require.NoError(t, f.Register(repeat))
+	f.Cross(CrossRule{
+		Name:   "password_match",
+		Fields: []string{"password", "repeat_password"},
+		Check: func(view ViewState) error {
+			if view.Components["password"].Value != view.Components["repeat_password"].Value {
+				return errors.New("两次输入的密码不一致")
+			}
+			return nil
+		},
+	})
+	assert.False(t, f.Valid())
+	assert.Equal(t, "请输入用户名", f.View().Components["username"].Error)
+
+	// 同步校验不通过时不执行异步校验
+	require.NoError(t, username.SetValue("ad"))
+	view := f.View()
+	assert.Equal(t, "至少 3 个字符", view.Components["username"].Error)
+	assert.False(t, view.Components["username"].Pending)
+
+	// 连续输入只校验最后一次
+	require.NoError(t, username.SetValue("adm"))
+	require.NoError(t, username.SetValue("admin"))
+	assert.True(t, f.View().Components["username"].Pending)
+	f.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, "admin", <-started)
+	view = f.View()
+	assert.False(t, view.Components["username"].Pending)
+	assert.Equal(t, "admin 已被占用", view.Components["username"].Error)
+
+	// 新的输入取消进行中的校验
+	require.NoError(t, username.SetValue("slow"))
+	assert.Equal(t, "slow", <-started)
+	require.NoError(t, username.SetValue("alice"))
+	f.Wait()
+	assert.Equal(t, "alice", <-started)
+	view = f.View()
+	assert.Equal(t, "", view.Components["username"].Error)
+
+	// 跨字段校验
+	require.NoError(t, password.SetValue("secret"))
+	require.NoError(t, repeat.SetValue("secret!"))
+	assert.Equal(t, "两次输入的密码不一致", f.View().Errors["password_match"])
+	assert.False(t, f.Valid())
+	require.NoError(t, repeat.SetValue("secret"))
+	assert.Empty(t, f.View().Errors)
+	assert.True(t, f.Valid())
+}
@@ -0,0 +1,418 @@
+package memento
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 增量备忘录
+// 大文档每次都保存完整快照太占内存，DeltaCaretaker 只保存相邻快照之间的差异，每隔若干个快照保存一次完整状态（检查点）
+// 恢复到任意快照时，从它之前最近的检查点开始依次应用差异
+// 检查点的间隔越小，恢复越快，占用的内存越多
+
+// Differ 计算和应用两个备忘录之间的差异，D 是差异的类型
+type Differ[M any, D any] interface {
+	Diff(from, to M) D
+	// Apply 在 base 上应用差异，不能修改 base
+	Apply(base M, delta D) (M, error)
+}
+
+type deltaSnapshot[M any, D any] struct {
+	// full 检查点的完整状态，不是检查点时为 nil
+	full  *M
+	delta D
+	label string
+	time  time.Time
+}
+
+// DeltaCaretaker 保存增量的负责人，用法与 Caretaker 相同，并发安全
+type DeltaCaretaker[M any, D any] struct {
+	lock       sync.Mutex
+	originator Originator[M]
+	differ     Differ[M, D]
+	option     CaretakerOption
+	history    []deltaSnapshot[M, D]
+	current    int
+	// head current 对应的完整状态，保存新快照时用来计算差异
+	head M
+}
+
+// NewDeltaCaretaker 创建时保存 originator 的初始状态
+func NewDeltaCaretaker[M any, D any](originator Originator[M], differ Differ[M, D], opts ...CaretakerOptFun) *DeltaCaretaker[M, D] {
+	c := &DeltaCaretaker[M, D]{originator: originator, differ: differ, option: newCaretakerOption(opts), current: -1}
+	// 第一个快照一定是检查点，不会出错
+	c.Save("initial")
+	return c
+}
+
+// Save 保存 originator 的当前状态，会丢弃可以重做的历史，超出容量时丢弃最早的快照
+func (c *DeltaCaretaker[M, D]) Save(label string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	state := c.originator.Save()
+	// 超出容量时丢弃最早的 drop 个快照，丢弃之前把剩下的第一个快照变成检查点
+	// 唯一可能出错的步骤放在修改历史之前，出错时历史保持不变
+	kept := c.current + 1
+	drop := max(kept+1-c.option.capacity, 0)
+	if drop > 0 && drop < kept && c.history[drop].full == nil {
+		full, err := c.materialize(drop)
+		if err != nil {
+			return err
+		}
+		c.history[drop].full = &full
+	}
+
+	c.history = c.history[:kept]
+	s := deltaSnapshot[M, D]{label: label, time: c.option.now()}
+	// 新快照成为第一个快照时也必须是检查点
+	if kept == drop || c.sinceCheckpoint() >= c.option.checkpoint-1 {
+		s.full = &state
+	} else {
+		s.delta = c.differ.Diff(c.head, state)
+	}
+	c.history = append(c.history, s)
+	c.history = append(c.history[:0], c.history[drop:]...)
+	c.current = len(c.history) - 1
+	c.head = state
+	return nil
+}
+
+// Undo 撤销 steps 步
+func (c *DeltaCaretaker[M, D]) Undo(steps int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if steps < 1 || c.current-steps < 0 {
+		return fmt.Errorf("%w: %d steps, %d available", ErrNoUndo, steps, c.current)
+	}
+	return c.restore(c.current - steps)
+}
+
+// Redo 重做 steps 步
+func (c *DeltaCaretaker[M, D]) Redo(steps int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if available := len(c.history) - 1 - c.current; steps < 1 || steps > available {
+		return fmt.Errorf("%w: %d steps, %d available", ErrNoRedo, steps, available)
+	}
+	return c.restore(c.current + steps)
+}
+
+// Goto 恢复到 History 中指定的快照
+func (c *DeltaCaretaker[M, D]) Goto(index int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if index < 0 || index >= len(c.history) {
+		return fmt.Errorf("snapshot %d out of range [0, %d)", index, len(c.history))
+	}
+	return c.restore(index)
+}
+
+// History 所有快照的描述信息，从早到晚排列，以及当前快照的位置
+func (c *DeltaCaretaker[M, D]) History() ([]Entry, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries := make([]Entry, len(c.history))
+	for i, s := range c.history {
+		entries[i] = Entry{Index: i, Label: s.label, Time: s.time}
+	}
+	return entries, c.current
+}
+
+// Checkpoints 检查点的位置
+func (c *DeltaCaretaker[M, D]) Checkpoints() []int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var indexes []int
+	for i, s := range c.history {
+		if s.full != nil {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// Compact 压缩历史：保留最近 recent 个快照、当前快照和所有检查点，其他较早的快照被丢弃
+// 被保留的快照之间重新计算差异，较早的历史只能恢复到检查点
+func (c *DeltaCaretaker[M, D]) Compact(recent int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	from := len(c.history) - recent
+	var (
+		compacted []deltaSnapshot[M, D]
+		current   int
+		state     M
+		prev      M
+		since     int
+	)
+	for i, s := range c.history {
+		// 依次恢复每个快照的完整状态，同时只保留两个完整状态
+		if s.full != nil {
+			state = *s.full
+		} else {
+			next, err := c.differ.Apply(state, s.delta)
+			if err != nil {
+				return fmt.Errorf("snapshot %d: %w", i, err)
+			}
+			state = next
+		}
+		if i < from && s.full == nil && i != c.current {
+			continue
+		}
+
+		kept := deltaSnapshot[M, D]{full: s.full, label: s.label, time: s.time}
+		if len(compacted) == 0 || (s.full == nil && since >= c.option.checkpoint-1) {
+			full := state
+			kept.full = &full
+		} else if s.full == nil {
+			kept.delta = c.differ.Diff(prev, state)
+		}
+		if kept.full != nil {
+			since = 0
+		} else {
+			since++
+		}
+		if i == c.current {
+			current = len(compacted)
+		}
+		compacted = append(compacted, kept)
+		prev = state
+	}
+	c.history = compacted
+	c.current = current
+	return nil
+}
+
+// sinceCheckpoint 最后一个快照之前连续的增量快照数量
+func (c *DeltaCaretaker[M, D]) sinceCheckpoint() int {
+	n := 0
+	for i := len(c.history) - 1; c.history[i].full == nil; i-- {
+		n++
+	}
+	return n
+}
+
+// materialize 从最近的检查点开始应用差异，得到 index 的完整状态
+func (c *DeltaCaretaker[M, D]) materialize(index int) (M, error) {
+	start := index
+	for c.history[start].full == nil {
+		start--
+	}
+	state := *c.history[start].full
+	for i := start + 1; i <= index; i++ {
+		next, err := c.differ.Apply(state, c.history[i].delta)
+		if err != nil {
+			return state, fmt.Errorf("snapshot %d: %w", i, err)
+		}
+		state = next
+	}
+	return state, nil
+}
+
+// restore 恢复失败时保持当前位置不变
+func (c *DeltaCaretaker[M, D]) restore(index int) error {
+	state, err := c.materialize(index)
+	if err != nil {
+		return err
+	}
+	if err := c.originator.Restore(state); err != nil {
+		return err
+	}
+	c.current = index
+	c.head = state
+	return nil
+}
+
+// 例子：编辑器的增量历史
+// 每次编辑只修改文档中的一小段，差异只需要记录公共前缀、公共后缀的长度和中间替换的内容
+
+// ErrDeltaMismatch 差异与基础状态不匹配
+var ErrDeltaMismatch = errors.New("delta does not match base")
+
+// editorDelta 把 base 中 prefix 之后、最后 suffix 个字节之前的内容替换为 insert
+type editorDelta struct {
+	prefix int
+	suffix int
+	insert string
+	cursor int
+}
+
+type editorDiffer struct{}
+
+func (editorDiffer) Diff(from, to editorMemento) editorDelta {
+	n := min(len(from.text), len(to.text))
+	prefix := 0
+	for prefix < n && from.text[prefix] == to.text[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && from.text[len(from.text)-1-suffix] == to.text[len(to.text)-1-suffix] {
+		suffix++
+	}
+	// 复制替换的内容，否则子串会引用整个文档
+	insert := strings.Clone(to.text[prefix : len(to.text)-suffix])
+	return editorDelta{prefix: prefix, suffix: suffix, insert: insert, cursor: to.cursor}
+}
+
+func (editorDiffer) Apply(base editorMemento, d editorDelta) (editorMemento, error) {
+	if d.prefix < 0 || d.suffix < 0 || d.prefix+d.suffix > len(base.text) {
+		return base, fmt.Errorf("%w: prefix %d suffix %d length %d", ErrDeltaMismatch, d.prefix, d.suffix, len(base.text))
+	}
+	text := base.text[:d.prefix] + d.insert + base.text[len(base.text)-d.suffix:]
+	return editorMemento{text: text, cursor: d.cursor}, nil
+}
+
+// NewEditorHistory 保存增量的编辑器历史
+func NewEditorHistory(editor *Editor, opts ...CaretakerOptFun) *DeltaCaretaker[editorMemento, editorDelta] {
+	return NewDeltaCaretaker[editorMemento, editorDelta](editor, editorDiffer{}, opts...)
+}
+
+func TestDeltaCaretaker(t *testing.T) {
+	editor := NewEditor()
+	history := NewEditorHistory(editor, WithCheckpointEvery(3), WithCapacity(8))
+
+	// 每个快照的文本，用来检查恢复的结果
+	texts := []string{""}
+	for _, s := range []string{"你好", "，", "世界", "！", "hello"} {
+		editor.Insert(s)
+		require.NoError(t, history.Save("insert "+s))
+		texts = append(texts, editor.Text())
+	}
+	assert.Equal(t, []int{0, 3}, history.Checkpoints())
+
+	// 恢复到任意快照
+	for i := len(texts) - 1; i >= 0; i-- {
+		require.NoError(t, history.Goto(i))
+		assert.Equal(t, texts[i], editor.Text())
+	}
+	assert.Equal(t, 0, editor.Cursor())
+	require.NoError(t, history.Redo(2))
+	assert.Equal(t, "你好，", editor.Text())
+	assert.True(t, errors.Is(history.Undo(3), ErrNoUndo))
+
+	// 撤销后的修改丢弃可以重做的历史，差异基于当前状态计算
+	require.NoError(t, editor.Move(1))
+	editor.Delete(1)
+	editor.Insert("您")
+	require.NoError(t, history.Save("replace"))
+	texts = append(texts[:3], "您好，")
+	assert.True(t, errors.Is(history.Redo(1), ErrNoRedo))
+	require.NoError(t, history.Undo(1))
+	assert.Equal(t, "你好，", editor.Text())
+	require.NoError(t, history.Redo(1))
+	assert.Equal(t, "您好，", editor.Text())
+	assert.Equal(t, 1, editor.Cursor())
+
+	// 超出容量时丢弃最早的快照，下一个快照变成检查点
+	for _, s := range []string{"a", "b", "c", "d", "e", "f"} {
+		editor.Insert(s)
+		require.NoError(t, history.Save("insert "+s))
+		texts = append(texts, editor.Text())
+	}
+	texts = texts[len(texts)-8:]
+	entries, current := history.History()
+	require.Len(t, entries, 8)
+	assert.Equal(t, 7, current)
+	assert.Equal(t, "insert ，", entries[0].Label)
+	assert.Equal(t, []int{0, 1, 4, 7}, history.Checkpoints())
+	for i := range texts {
+		require.NoError(t, history.Goto(i))
+		assert.Equal(t, texts[i], editor.Text())
+	}
+
+	// 压缩：只保留最近 3 个快照、当前快照和检查点
+	require.NoError(t, history.Goto(2))
+	require.NoError(t, history.Compact(3))
+	entries, current = history.History()
+	var labels []string
+	for _, e := range entries {
+		labels = append(labels, e.Label)
+	}
+	assert.Equal(t, []string{"insert ，", "replace", "insert a", "insert c", "insert d", "insert e", "insert f"}, labels)
+	assert.Equal(t, 2, current)
+	kept := []string{texts[0], texts[1], texts[2], texts[4], texts[5], texts[6], texts[7]}
+	for i := len(kept) - 1; i >= 0; i-- {
+		require.NoError(t, history.Goto(i))
+		assert.Equal(t, kept[i], editor.Text())
+	}
+
+	// 损坏的差异不会改变编辑器的状态
+	assert.Equal(t, []int{0, 1, 3, 6}, history.Checkpoints())
+	history.history[5].delta.prefix = 1000
+	assert.True(t, errors.Is(history.Goto(5), ErrDeltaMismatch))
+	assert.Equal(t, kept[0], editor.Text())
+
+	// 超出容量时无法生成新的检查点，保存失败，历史保持不变
+	history = NewEditorHistory(editor, WithCheckpointEvery(10), WithCapacity(3))
+	for _, s := range []string{"x", "y"} {
+		editor.Insert(s)
+		require.NoError(t, history.Save("insert "+s))
+	}
+	history.history[1].delta.prefix = 1000
+	before, current := history.History()
+	editor.Insert("z")
+	assert.True(t, errors.Is(history.Save("insert z"), ErrDeltaMismatch))
+	entries, current = history.History()
+	assert.Equal(t, before, entries)
+	assert.Equal(t, 2, current)
+	assert.Equal(t, []int{0}, history.Checkpoints())
+}
+
+// 在 64KB 的文档上编辑 200 次并保存，比较历史占用的内存
+const (
+	benchDocument = 64 << 10
+	benchEdits    = 200
+)
+
+func BenchmarkHistory_Full(b *testing.B) {
+	benchmarkHistory(b, func(editor *Editor) func(label string) error {
+		return NewCaretaker[editorMemento](editor, WithCapacity(benchEdits+1)).Save
+	})
+}
+
+func BenchmarkHistory_Delta(b *testing.B) {
+	benchmarkHistory(b, func(editor *Editor) func(label string) error {
+		return NewEditorHistory(editor, WithCapacity(benchEdits+1)).Save
+	})
+}
+
+func benchmarkHistory(b *testing.B, newHistory func(editor *Editor) func(label string) error) {
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		editor := NewEditor()
+		editor.Insert(strings.Repeat("x", benchDocument))
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		save := newHistory(editor)
+		for j := 0; j < benchEdits; j++ {
+			_ = editor.Move(j * benchDocument / benchEdits)
+			editor.Insert("edit")
+			if err := save("edit"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(save)
+		if after.HeapAlloc > before.HeapAlloc {
+			retained += after.HeapAlloc - before.HeapAlloc
+		}
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+}
@@ -0,0 +1,159 @@
+package memento
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 例子：文本编辑器的撤销和重做
+// Editor 是 Originator，editorMemento 的字段不导出，其他包只能保存，不能读取或修改
+
+// Editor 文本编辑器
+type Editor struct {
+	text   []rune
+	cursor int
+}
+
+// editorMemento 编辑器的备忘录
+type editorMemento struct {
+	text   string
+	cursor int
+}
+
+func NewEditor() *Editor {
+	return &Editor{}
+}
+
+func (e *Editor) Text() string {
+	return string(e.text)
+}
+
+func (e *Editor) Cursor() int {
+	return e.cursor
+}
+
+// Insert 在光标处插入文本，光标移动到插入的文本之后
+func (e *Editor) Insert(s string) {
+	r := []rune(s)
+	e.text = append(e.text[:e.cursor], append(r, e.text[e.cursor:]...)...)
+	e.cursor += len(r)
+}
+
+// Delete 删除光标前的 n 个字符
+func (e *Editor) Delete(n int) {
+	n = min(n, e.cursor)
+	e.text = append(e.text[:e.cursor-n], e.text[e.cursor:]...)
+	e.cursor -= n
+}
+
+// Move 移动光标
+func (e *Editor) Move(cursor int) error {
+	if cursor < 0 || cursor > len(e.text) {
+		return fmt.Errorf("cursor %d out of range [0, %d]", cursor, len(e.text))
+	}
+	e.cursor = cursor
+	return nil
+}
+
+func (e *Editor) Save() editorMemento {
+	return editorMemento{text: string(e.text), cursor: e.cursor}
+}
+
+// Restore 备忘录可能来自文件，光标越界时不修改编辑器
+func (e *Editor) Restore(m editorMemento) error {
+	text := []rune(m.text)
+	if m.cursor < 0 || m.cursor > len(text) {
+		return fmt.Errorf("cursor %d out of range [0, %d]", m.cursor, len(text))
+	}
+	e.text = text
+	e.cursor = m.cursor
+	return nil
+}
+
+// editorRecord 编辑器快照的存储结构，版本 2 增加了光标位置
+type editorRecord struct {
+	Text   string
+	Cursor int
+}
+
+// editorRecordV1 版本 1 的存储结构
+type editorRecordV1 struct {
+	Text string
+}
+
+// NewEditorSerializer 编辑器快照的编码方式，可以读取版本 1 的快照
+func NewEditorSerializer(codec Codec) *Serializer[editorMemento] {
+	schema := Schema[editorMemento]{
+		Version: 2,
+		Encode: func(m editorMemento) any {
+			return editorRecord{Text: m.text, Cursor: m.cursor}
+		},
+		Decode: func(dec Decoder) (editorMemento, error) {
+			var r editorRecord
+			err := dec.Decode(&r)
+			return editorMemento{text: r.Text, cursor: r.Cursor}, err
+		},
+	}
+	return NewSerializer(codec, schema).Migrate(1, func(dec Decoder) (editorMemento, error) {
+		var r editorRecordV1
+		err := dec.Decode(&r)
+		// 旧版本没有保存光标，放在末尾
+		return editorMemento{text: r.Text, cursor: len([]rune(r.Text))}, err
+	})
+}
+
+func TestEditor_Undo(t *testing.T) {
+	now := time.Unix(0, 0)
+	editor := NewEditor()
+	history := NewCaretaker[editorMemento](editor, WithCapacity(4), WithClock(func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}))
+
+	editor.Insert("hello")
+	history.Save("insert hello")
+	editor.Insert(" world")
+	history.Save("insert world")
+	require.NoError(t, editor.Move(5))
+	editor.Insert(",")
+	history.Save("insert comma")
+	assert.Equal(t, "hello, world", editor.Text())
+
+	// 撤销两步
+	require.NoError(t, history.Undo(2))
+	assert.Equal(t, "hello", editor.Text())
+	assert.Equal(t, 5, editor.Cursor())
+	require.NoError(t, history.Redo(1))
+	assert.Equal(t, "hello world", editor.Text())
+	assert.True(t, errors.Is(history.Redo(2), ErrNoRedo))
+
+	// 新的修改丢弃可以重做的历史
+	editor.Delete(6)
+	editor.Insert("!")
+	history.Save("replace world")
+	assert.True(t, errors.Is(history.Redo(1), ErrNoRedo))
+
+	// 最多保留 4 个快照，最早的初始状态被丢弃
+	editor.Insert("!")
+	history.Save("exclaim")
+	entries, current := history.History()
+	var labels []string
+	for _, e := range entries {
+		labels = append(labels, e.Label)
+	}
+	assert.Equal(t, []string{"insert hello", "insert world", "replace world", "exclaim"}, labels)
+	assert.Equal(t, 3, current)
+	assert.True(t, entries[0].Time.Before(entries[3].Time))
+
+	assert.True(t, errors.Is(history.Undo(4), ErrNoUndo))
+	require.NoError(t, history.Undo(3))
+	assert.Equal(t, "hello", editor.Text())
+	require.NoError(t, history.Goto(3))
+	assert.Equal(t, "hello!!", editor.Text())
+	assert.Error(t, history.Goto(4))
+}
@@ -1 +1,171 @@
+// Package memento 备忘录模式
+// 定义：在不违背封装原则的前提下，捕获一个对象的内部状态，并在该对象之外保存这个状态，以便之后恢复对象为先前的状态
+// 角色：Originator - 需要保存状态的对象，负责生成备忘录和从备忘录恢复
+// Memento - 备忘录，对其他对象不透明，只有 Originator 能读取其中的内容
+// Caretaker - 负责保存备忘录，但不能修改或读取备忘录的内容
+// 和命令模式的区别：备忘录模式保存的是状态，撤销时直接恢复；命令模式保存的是操作，撤销时执行反向操作
 package memento
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoUndo 没有可以撤销的历史
+	ErrNoUndo = errors.New("nothing to undo")
+	// ErrNoRedo 没有可以重做的历史
+	ErrNoRedo = errors.New("nothing to redo")
+)
+
+// Originator 原发器，M 是它自己定义的备忘录类型
+// 备忘录类型的字段一般不导出，这样 Caretaker 和其他包都无法读取或修改
+type Originator[M any] interface {
+	Save() M
+	Restore(m M) error
+}
+
+// Entry 历史记录的描述信息，不包含备忘录本身
+type Entry struct {
+	Index int
+	Label string
+	Time  time.Time
+}
+
+type snapshot[M any] struct {
+	memento M
+	label   string
+	time    time.Time
+}
+
+// CaretakerOption Caretaker 的可选参数
+type CaretakerOption struct {
+	capacity   int
+	checkpoint int
+	now        func() time.Time
+}
+
+type CaretakerOptFun func(option *CaretakerOption)
+
+// WithCapacity 最多保留多少个快照，超出时丢弃最早的，默认 100 个
+func WithCapacity(n int) CaretakerOptFun {
+	return func(option *CaretakerOption) {
+		option.capacity = n
+	}
+}
+
+// WithCheckpointEvery 增量保存时，每 n 个快照保存一次完整状态，默认 10 个
+func WithCheckpointEvery(n int) CaretakerOptFun {
+	return func(option *CaretakerOption) {
+		option.checkpoint = n
+	}
+}
+
+// WithClock 替换时钟，用于测试
+func WithClock(now func() time.Time) CaretakerOptFun {
+	return func(option *CaretakerOption) {
+		option.now = now
+	}
+}
+
+// Caretaker 负责人，保存 originator 的历史快照，支持撤销和重做，并发安全
+// current 指向与 originator 当前状态一致的快照，撤销时恢复到前一个，重做时恢复到后一个
+type Caretaker[M any] struct {
+	lock       sync.Mutex
+	originator Originator[M]
+	option     CaretakerOption
+	history    []snapshot[M]
+	current    int
+}
+
+// NewCaretaker 创建时保存 originator 的初始状态
+func NewCaretaker[M any](originator Originator[M], opts ...CaretakerOptFun) *Caretaker[M] {
+	option := newCaretakerOption(opts)
+	c := &Caretaker[M]{originator: originator, option: option, current: -1}
+	c.Save("initial")
+	return c
+}
+
+func newCaretakerOption(opts []CaretakerOptFun) CaretakerOption {
+	option := CaretakerOption{capacity: 100, checkpoint: 10, now: time.Now}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	option.capacity = max(option.capacity, 1)
+	option.checkpoint = max(option.checkpoint, 1)
+	return option
+}
+
+// Save 保存 originator 的当前状态，会丢弃可以重做的历史
+// 完整快照的保存不会出错，返回 error 是为了和 DeltaCaretaker、FileCaretaker 保持一致
+func (c *Caretaker[M]) Save(label string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.history = append(c.history[:c.current+1], snapshot[M]{
+		memento: c.originator.Save(),
+		label:   label,
+		time:    c.option.now(),
+	})
+	if len(c.history) > c.option.capacity {
+		c.history = append(c.history[:0], c.history[len(c.history)-c.option.capacity:]...)
+	}
+	c.current = len(c.history) - 1
+	return nil
+}
+
+// Undo 撤销 steps 步
+func (c *Caretaker[M]) Undo(steps int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if steps < 1 || c.current-steps < 0 {
+		return fmt.Errorf("%w: %d steps, %d available", ErrNoUndo, steps, c.current)
+	}
+	return c.restore(c.current - steps)
+}
+
+// Redo 重做 steps 步
+func (c *Caretaker[M]) Redo(steps int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if available := len(c.history) - 1 - c.current; steps < 1 || steps > available {
+		return fmt.Errorf("%w: %d steps, %d available", ErrNoRedo, steps, available)
+	}
+	return c.restore(c.current + steps)
+}
+
+// Goto 恢复到 History 中指定的快照
+func (c *Caretaker[M]) Goto(index int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if index < 0 || index >= len(c.history) {
+		return fmt.Errorf("snapshot %d out of range [0, %d)", index, len(c.history))
+	}
+	return c.restore(index)
+}
+
+// History 所有快照的描述信息，从早到晚排列，以及当前快照的位置
+func (c *Caretaker[M]) History() ([]Entry, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries := make([]Entry, len(c.history))
+	for i, s := range c.history {
+		entries[i] = Entry{Index: i, Label: s.label, Time: s.time}
+	}
+	return entries, c.current
+}
+
+// restore 恢复失败时保持当前位置不变
+func (c *Caretaker[M]) restore(index int) error {
+	if err := c.originator.Restore(c.history[index].memento); err != nil {
+		return err
+	}
+	c.current = index
+	return nil
+}
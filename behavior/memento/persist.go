@@ -0,0 +1,453 @@
+package memento
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 持久化备忘录
+// 快照先写入结构版本号，再写入备忘录的存储结构，读取时按版本号选择解码方式
+// Originator 的结构变化时升级版本号，并为旧版本注册迁移函数，旧版本的快照仍然可以恢复
+// FileCaretaker 把每个快照保存为目录中的一个文件，索引文件记录快照的顺序和当前位置，重启之后可以继续撤销和重做
+
+var (
+	// ErrUnknownVersion 快照的结构版本没有对应的解码方式
+	ErrUnknownVersion = errors.New("unknown schema version")
+)
+
+// Encoder 编码器，gob.Encoder 和 json.Encoder 都实现了这个接口
+type Encoder interface {
+	Encode(v any) error
+}
+
+// Decoder 解码器，gob.Decoder 和 json.Decoder 都实现了这个接口
+type Decoder interface {
+	Decode(v any) error
+}
+
+// Codec 编码格式
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+	// Ext 快照文件的扩展名
+	Ext() string
+}
+
+type gobCodec struct{}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+func (gobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
+func (gobCodec) Ext() string                    { return ".gob" }
+
+type jsonCodec struct{}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+func (jsonCodec) Ext() string                    { return ".json" }
+
+var (
+	// Gob 紧凑，只能被 Go 读取
+	Gob Codec = gobCodec{}
+	// JSON 可读，方便排查问题
+	JSON Codec = jsonCodec{}
+)
+
+// Schema 备忘录的存储结构
+// 备忘录的字段一般不导出，无法直接编码，由 Originator 所在的包提供与存储结构之间的转换
+type Schema[M any] struct {
+	Version int
+	// Encode 把备忘录转换成当前版本的存储结构
+	Encode func(m M) any
+	// Decode 解码当前版本的存储结构
+	Decode func(dec Decoder) (M, error)
+}
+
+// Migration 解码旧版本的存储结构并转换成当前的备忘录
+type Migration[M any] func(dec Decoder) (M, error)
+
+type header struct {
+	Version int
+}
+
+// Serializer 按 Schema 编码和解码备忘录
+type Serializer[M any] struct {
+	codec      Codec
+	schema     Schema[M]
+	migrations map[int]Migration[M]
+}
+
+func NewSerializer[M any](codec Codec, schema Schema[M]) *Serializer[M] {
+	return &Serializer[M]{codec: codec, schema: schema, migrations: map[int]Migration[M]{}}
+}
+
+// Migrate 注册旧版本的迁移函数
+func (s *Serializer[M]) Migrate(version int, migration Migration[M]) *Serializer[M] {
+	s.migrations[version] = migration
+	return s
+}
+
+// Marshal 写入版本号和当前版本的存储结构
+func (s *Serializer[M]) Marshal(w io.Writer, m M) error {
+	enc := s.codec.NewEncoder(w)
+	if err := enc.Encode(header{Version: s.schema.Version}); err != nil {
+		return err
+	}
+	return enc.Encode(s.schema.Encode(m))
+}
+
+// Unmarshal 读取版本号，当前版本直接解码，旧版本交给迁移函数
+func (s *Serializer[M]) Unmarshal(r io.Reader) (M, error) {
+	var (
+		h   header
+		m   M
+		dec = s.codec.NewDecoder(r)
+	)
+	if err := dec.Decode(&h); err != nil {
+		return m, err
+	}
+	if h.Version == s.schema.Version {
+		return s.schema.Decode(dec)
+	}
+	migration, ok := s.migrations[h.Version]
+	if !ok {
+		return m, fmt.Errorf("%w: %d, current %d", ErrUnknownVersion, h.Version, s.schema.Version)
+	}
+	return migration(dec)
+}
+
+// fileIndex 索引文件的内容，总是使用 JSON 编码
+type fileIndex struct {
+	// Next 下一个快照文件的序号，文件名不会重复使用
+	Next    int
+	Current int
+	Entries []fileEntry
+}
+
+type fileEntry struct {
+	File  string
+	Label string
+	Time  time.Time
+}
+
+const indexFile = "index.json"
+
+// FileCaretaker 把快照保存在目录中的负责人，用法与 Caretaker 相同，并发安全
+// 同一个目录只能被一个 FileCaretaker 使用
+type FileCaretaker[M any] struct {
+	lock       sync.Mutex
+	dir        string
+	originator Originator[M]
+	serializer *Serializer[M]
+	option     CaretakerOption
+	index      fileIndex
+}
+
+// OpenFileCaretaker 目录中已有快照时，把 originator 恢复到上次的当前快照，否则保存初始状态
+func OpenFileCaretaker[M any](dir string, originator Originator[M], serializer *Serializer[M], opts ...CaretakerOptFun) (*FileCaretaker[M], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &FileCaretaker[M]{dir: dir, originator: originator, serializer: serializer, option: newCaretakerOption(opts)}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		c.index.Current = -1
+		return c, c.Save("initial")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.index); err != nil {
+		return nil, fmt.Errorf("index %s: %w", dir, err)
+	}
+	if c.index.Current < 0 || c.index.Current >= len(c.index.Entries) {
+		return nil, fmt.Errorf("index %s: snapshot %d out of range [0, %d)", dir, c.index.Current, len(c.index.Entries))
+	}
+	if err := c.restore(c.index.Current); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save 保存 originator 的当前状态，会丢弃可以重做的历史，超出容量时删除最早的快照
+func (c *FileCaretaker[M]) Save(label string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	name := fmt.Sprintf("snapshot-%06d%s", c.index.Next, c.serializer.codec.Ext())
+	m := c.originator.Save()
+	err := writeFile(filepath.Join(c.dir, name), func(w io.Writer) error {
+		return c.serializer.Marshal(w, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	index := fileIndex{Next: c.index.Next + 1}
+	index.Entries = append(index.Entries, c.index.Entries[:c.index.Current+1]...)
+	index.Entries = append(index.Entries, fileEntry{File: name, Label: label, Time: c.option.now()})
+	if len(index.Entries) > c.option.capacity {
+		index.Entries = index.Entries[len(index.Entries)-c.option.capacity:]
+	}
+	index.Current = len(index.Entries) - 1
+	return c.commit(index)
+}
+
+// Undo 撤销 steps 步
+func (c *FileCaretaker[M]) Undo(steps int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if steps < 1 || c.index.Current-steps < 0 {
+		return fmt.Errorf("%w: %d steps, %d available", ErrNoUndo, steps, c.index.Current)
+	}
+	return c.move(c.index.Current - steps)
+}
+
+// Redo 重做 steps 步
+func (c *FileCaretaker[M]) Redo(steps int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if available := len(c.index.Entries) - 1 - c.index.Current; steps < 1 || steps > available {
+		return fmt.Errorf("%w: %d steps, %d available", ErrNoRedo, steps, available)
+	}
+	return c.move(c.index.Current + steps)
+}
+
+// Goto 恢复到 History 中指定的快照
+func (c *FileCaretaker[M]) Goto(index int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if index < 0 || index >= len(c.index.Entries) {
+		return fmt.Errorf("snapshot %d out of range [0, %d)", index, len(c.index.Entries))
+	}
+	return c.move(index)
+}
+
+// History 所有快照的描述信息，从早到晚排列，以及当前快照的位置
+func (c *FileCaretaker[M]) History() ([]Entry, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries := make([]Entry, len(c.index.Entries))
+	for i, e := range c.index.Entries {
+		entries[i] = Entry{Index: i, Label: e.Label, Time: e.Time}
+	}
+	return entries, c.index.Current
+}
+
+// move 恢复快照并把当前位置写入索引
+// 索引写入失败时把 originator 恢复到原来的快照，保持与索引一致
+func (c *FileCaretaker[M]) move(index int) error {
+	current := c.index.Current
+	if err := c.restore(index); err != nil {
+		return err
+	}
+	next := c.index
+	next.Current = index
+	if err := c.commit(next); err != nil {
+		// 索引已经写入，只是删除多余的快照文件失败
+		if c.index.Current == index {
+			return err
+		}
+		if rollbackErr := c.restore(current); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// restore 恢复失败时保持当前位置不变
+func (c *FileCaretaker[M]) restore(index int) error {
+	f, err := os.Open(filepath.Join(c.dir, c.index.Entries[index].File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := c.serializer.Unmarshal(f)
+	if err != nil {
+		return fmt.Errorf("snapshot %s: %w", c.index.Entries[index].File, err)
+	}
+	return c.originator.Restore(m)
+}
+
+// commit 先写入新的索引，再删除不再引用的快照文件，中途失败时最多留下多余的文件
+func (c *FileCaretaker[M]) commit(index fileIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(c.dir, indexFile), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool, len(index.Entries))
+	for _, e := range index.Entries {
+		kept[e.File] = true
+	}
+	var errs []error
+	for _, e := range c.index.Entries {
+		if !kept[e.File] {
+			if err := os.Remove(filepath.Join(c.dir, e.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	c.index = index
+	return errors.Join(errs...)
+}
+
+// writeFile 先写入临时文件再重命名，避免留下写了一半的文件
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir 持久化重命名后的目录项，部分系统（例如 Windows）不支持，忽略错误
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func TestSerializer(t *testing.T) {
+	editor := NewEditor()
+	editor.Insert("hello, 世界")
+	require.NoError(t, editor.Move(5))
+
+	for _, codec := range []Codec{Gob, JSON} {
+		t.Run(codec.Ext(), func(t *testing.T) {
+			serializer := NewEditorSerializer(codec)
+			var buf bytes.Buffer
+			require.NoError(t, serializer.Marshal(&buf, editor.Save()))
+			m, err := serializer.Unmarshal(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, editor.Save(), m)
+
+			// 版本 1 只保存了文本，迁移时光标放在末尾
+			buf.Reset()
+			enc := codec.NewEncoder(&buf)
+			require.NoError(t, enc.Encode(header{Version: 1}))
+			require.NoError(t, enc.Encode(editorRecordV1{Text: "你好"}))
+			m, err = serializer.Unmarshal(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, editorMemento{text: "你好", cursor: 2}, m)
+
+			buf.Reset()
+			require.NoError(t, codec.NewEncoder(&buf).Encode(header{Version: 3}))
+			_, err = serializer.Unmarshal(&buf)
+			assert.True(t, errors.Is(err, ErrUnknownVersion))
+		})
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, NewEditorSerializer(JSON).Marshal(&buf, editor.Save()))
+	assert.Equal(t, "{\"Version\":2}\n{\"Text\":\"hello, 世界\",\"Cursor\":5}\n", buf.String())
+}
+
+func TestFileCaretaker(t *testing.T) {
+	dir := t.TempDir()
+	editor := NewEditor()
+	history, err := OpenFileCaretaker(dir, editor, NewEditorSerializer(Gob), WithCapacity(3))
+	require.NoError(t, err)
+
+	editor.Insert("hello")
+	require.NoError(t, history.Save("insert hello"))
+	editor.Insert(" world")
+	require.NoError(t, history.Save("insert world"))
+	require.NoError(t, history.Undo(1))
+
+	// 重启之后恢复到上次的当前快照，可以继续重做
+	editor = NewEditor()
+	history, err = OpenFileCaretaker(dir, editor, NewEditorSerializer(Gob), WithCapacity(3))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", editor.Text())
+	assert.Equal(t, 5, editor.Cursor())
+	require.NoError(t, history.Redo(1))
+	assert.Equal(t, "hello world", editor.Text())
+
+	// 超出容量时删除最早的快照文件，撤销后的修改删除可以重做的快照文件
+	editor.Insert("!")
+	require.NoError(t, history.Save("exclaim"))
+	require.NoError(t, history.Undo(2))
+	editor.Insert("?")
+	require.NoError(t, history.Save("question"))
+	entries, current := history.History()
+	var labels []string
+	for _, e := range entries {
+		labels = append(labels, e.Label)
+	}
+	assert.Equal(t, []string{"insert hello", "question"}, labels)
+	assert.Equal(t, 1, current)
+	assert.True(t, errors.Is(history.Redo(1), ErrNoRedo))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	assert.ElementsMatch(t, []string{"index.json", "snapshot-000001.gob", "snapshot-000004.gob"}, files)
+
+	// 索引写入失败时编辑器恢复到原来的快照
+	index := filepath.Join(dir, "index.json")
+	data, err := os.ReadFile(index)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(index))
+	require.NoError(t, os.MkdirAll(filepath.Join(index, "busy"), 0o755))
+	assert.Error(t, history.Undo(1))
+	assert.Equal(t, "hello?", editor.Text())
+	_, current = history.History()
+	assert.Equal(t, 1, current)
+	require.NoError(t, os.RemoveAll(index))
+	require.NoError(t, os.WriteFile(index, data, 0o644))
+
+	// 快照损坏时不会改变编辑器的状态
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot-000001.gob"), []byte("broken"), 0o644))
+	assert.Error(t, history.Undo(1))
+	assert.Equal(t, "hello?", editor.Text())
+	_, current = history.History()
+	assert.Equal(t, 1, current)
+}
@@ -3,6 +3,13 @@
 
 package observer
 
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
 // 基础实现
 type IObserver interface {
 	Update(msg string)
@@ -14,25 +21,68 @@ type ISubject interface {
 	Notify(msg string)
 }
 
-type Subject struct {
-	observers []IObserver
+// subjectAdapter 基于泛型 Subject[string] 实现 ISubject，并发安全
+type subjectAdapter struct {
+	subject *Subject[string]
+	lock    sync.Mutex
+	subs    map[IObserver]*Subscription
 }
 
-func (s *Subject) Register(observer IObserver)  {
-	s.observers = append(s.observers, observer)
+// AdaptSubject 将泛型 Subject[string] 适配为基础的 ISubject
+func AdaptSubject(subject *Subject[string]) ISubject {
+	return &subjectAdapter{
+		subject: subject,
+		subs:    map[IObserver]*Subscription{},
+	}
 }
 
-func (s *Subject) Remove(observer IObserver)  {
-	for i,v:=range s.observers{
-		if v==observer{
-		  s.observers = append(s.observers[:i], s.observers[i+1:]...)
-		}
+// Register 同一个观察者重复注册只会生效一次
+func (a *subjectAdapter) Register(observer IObserver) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.subs[observer]; ok {
+		return
 	}
+	a.subs[observer] = a.subject.RegisterFunc(observer.Update)
 }
 
-func (s *Subject) Notify(msg string)  {
-	for _,ob:=range s.observers{
-		ob.Update(msg)
+func (a *subjectAdapter) Remove(observer IObserver) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if sub, ok := a.subs[observer]; ok {
+		sub.Cancel()
+		delete(a.subs, observer)
 	}
 }
 
+func (a *subjectAdapter) Notify(msg string) {
+	a.subject.Notify(msg)
+}
+
+type logObserver struct {
+	msgs []string
+}
+
+func (o *logObserver) Update(msg string) {
+	o.msgs = append(o.msgs, msg)
+}
+
+func TestAdaptSubject(t *testing.T) {
+	a, b, c := &logObserver{}, &logObserver{}, &logObserver{}
+	s := AdaptSubject(NewSubject[string]())
+	s.Register(a)
+	s.Register(b)
+	s.Register(b)
+	s.Register(c)
+	s.Notify("1")
+
+	// 原实现在遍历中修改切片，会跳过被移除元素之后的观察者
+	s.Remove(b)
+	s.Notify("2")
+
+	assert.Equal(t, []string{"1", "2"}, a.msgs)
+	assert.Equal(t, []string{"1"}, b.msgs)
+	assert.Equal(t, []string{"1", "2"}, c.msgs)
+}
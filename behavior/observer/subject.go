@@ -0,0 +1,253 @@
+package observer
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"weak"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 泛型实现：并发安全的 Subject[T]
+// 1）观察者列表采用写时复制，Notify 对快照进行遍历，通知过程中注册/移除观察者不会相互影响
+// 2）支持普通注册、作用域注册（context 结束后自动移除）、弱引用注册（观察者被回收后自动移除）
+// 3）支持可选的异步通知，通过 Wait 等待所有异步通知完成
+
+// Observer 泛型观察者
+type Observer[T any] interface {
+	Update(msg T)
+}
+
+// ObserverFunc 函数形式的观察者
+type ObserverFunc[T any] func(msg T)
+
+// Update 实现 Observer
+func (f ObserverFunc[T]) Update(msg T) {
+	f(msg)
+}
+
+// Subscription 注册凭证，用于取消注册
+type Subscription struct {
+	once   sync.Once
+	cancel func()
+}
+
+// Cancel 取消注册，可以重复调用
+func (s *Subscription) Cancel() {
+	s.once.Do(s.cancel)
+}
+
+// SubjectOption Subject 的可选参数
+type SubjectOption struct {
+	async bool
+}
+
+type SubjectOptFun func(option *SubjectOption)
+
+// WithAsync 每个观察者在独立的 goroutine 中接收通知
+func WithAsync() SubjectOptFun {
+	return func(option *SubjectOption) {
+		option.async = true
+	}
+}
+
+// entry 观察者记录，update 返回 false 表示观察者已失效（弱引用已被回收）
+type entry[T any] struct {
+	id     uint64
+	update func(msg T) bool
+}
+
+// Subject 并发安全的泛型被观察者，零值可以直接使用（同步通知）
+type Subject[T any] struct {
+	lock    sync.Mutex
+	seq     uint64
+	entries []*entry[T]
+	async   bool
+	wg      sync.WaitGroup
+}
+
+func NewSubject[T any](opts ...SubjectOptFun) *Subject[T] {
+	option := &SubjectOption{}
+	for _, opt := range opts {
+		opt(option)
+	}
+	return &Subject[T]{async: option.async}
+}
+
+// Register 注册观察者
+func (s *Subject[T]) Register(observer Observer[T]) *Subscription {
+	return s.subscription(s.add(s.update(observer)))
+}
+
+// RegisterFunc 注册函数观察者
+func (s *Subject[T]) RegisterFunc(fn func(msg T)) *Subscription {
+	return s.Register(ObserverFunc[T](fn))
+}
+
+// RegisterScoped 注册观察者，ctx 结束时自动移除
+func (s *Subject[T]) RegisterScoped(ctx context.Context, observer Observer[T]) *Subscription {
+	id := s.add(s.update(observer))
+	stop := context.AfterFunc(ctx, func() { s.remove(id) })
+	return &Subscription{cancel: func() {
+		stop()
+		s.remove(id)
+	}}
+}
+
+// RegisterWeak 以弱引用的方式注册观察者，Subject 不会阻止观察者被回收，回收后在下一次通知时自动移除
+// 由于方法不能携带类型参数，这里使用函数的形式
+func RegisterWeak[T any, O any, P interface {
+	*O
+	Observer[T]
+}](s *Subject[T], observer P) *Subscription {
+	wp := weak.Make((*O)(observer))
+	return s.subscription(s.add(func(msg T) bool {
+		p := wp.Value()
+		if p == nil {
+			return false
+		}
+		P(p).Update(msg)
+		return true
+	}))
+}
+
+// Notify 通知所有观察者
+func (s *Subject[T]) Notify(msg T) {
+	s.lock.Lock()
+	snapshot := s.entries
+	s.lock.Unlock()
+
+	for _, e := range snapshot {
+		if !s.async {
+			if !e.update(msg) {
+				s.remove(e.id)
+			}
+			continue
+		}
+
+		s.wg.Add(1)
+		go func(e *entry[T]) {
+			defer s.wg.Done()
+			if !e.update(msg) {
+				s.remove(e.id)
+			}
+		}(e)
+	}
+}
+
+// Wait 等待已经发出的异步通知全部完成，不要和 Notify 并发调用
+func (s *Subject[T]) Wait() {
+	s.wg.Wait()
+}
+
+// Len 当前注册的观察者数量
+func (s *Subject[T]) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+func (s *Subject[T]) update(observer Observer[T]) func(msg T) bool {
+	return func(msg T) bool {
+		observer.Update(msg)
+		return true
+	}
+}
+
+func (s *Subject[T]) subscription(id uint64) *Subscription {
+	return &Subscription{cancel: func() { s.remove(id) }}
+}
+
+func (s *Subject[T]) add(update func(msg T) bool) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	id := s.seq
+	entries := make([]*entry[T], 0, len(s.entries)+1)
+	entries = append(entries, s.entries...)
+	s.entries = append(entries, &entry[T]{id: id, update: update})
+	return id
+}
+
+// remove 写时复制，不会影响正在遍历的快照
+func (s *Subject[T]) remove(id uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make([]*entry[T], 0, len(s.entries))
+	for _, e := range s.entries {
+		if e.id != id {
+			entries = append(entries, e)
+		}
+	}
+	s.entries = entries
+}
+
+// counter 测试用观察者，names 字段保证对象不会走 tiny 分配器，以便 GC 后弱引用能够失效
+type counter struct {
+	n     int64
+	names []string
+}
+
+func (c *counter) Update(msg int) {
+	atomic.AddInt64(&c.n, int64(msg))
+}
+
+func TestSubject_Notify(t *testing.T) {
+	s := NewSubject[int]()
+
+	// 通知过程中移除自身，不影响其他观察者收到本次通知
+	var first, second int
+	var sub *Subscription
+	sub = s.RegisterFunc(func(msg int) {
+		first += msg
+		sub.Cancel()
+	})
+	s.RegisterFunc(func(msg int) { second += msg })
+	s.Notify(1)
+	s.Notify(2)
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 3, second)
+	assert.Equal(t, 1, s.Len())
+
+	// 作用域注册
+	ctx, cancel := context.WithCancel(context.Background())
+	s.RegisterScoped(ctx, &counter{})
+	assert.Equal(t, 2, s.Len())
+	cancel()
+	assert.Eventually(t, func() bool { return s.Len() == 1 }, time.Second, time.Millisecond)
+
+	// 弱引用注册
+	c := &counter{}
+	RegisterWeak[int](s, c)
+	s.Notify(1)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&c.n))
+	c = nil
+	runtime.GC()
+	s.Notify(1)
+	assert.Equal(t, 1, s.Len())
+
+	// 并发注册、通知、取消以及异步通知
+	as := NewSubject[int](WithAsync())
+	total := &counter{}
+	as.Register(total)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := as.Register(&counter{})
+			as.Notify(1)
+			sub.Cancel()
+		}()
+	}
+	wg.Wait()
+	as.Wait()
+	assert.Equal(t, int64(50), atomic.LoadInt64(&total.n))
+	assert.Equal(t, 1, as.Len())
+}
@@ -0,0 +1,133 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 将状态机定义导出为 Graphviz DOT 和 Mermaid 状态图，文档和代码使用同一份定义生成
+// 转移的标签格式为 "事件 [守卫条件] / 动作"，current 不为空时高亮实例的当前状态
+
+// DOT 导出 Graphviz DOT 格式
+func DOT(def *Definition, current string) string {
+	var b strings.Builder
+	b.WriteString("digraph fsm {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box, style=rounded];\n")
+	b.WriteString("\t__start [shape=point];\n")
+	fmt.Fprintf(&b, "\t__start -> %s;\n", dotQuote(def.Initial()))
+
+	for _, s := range def.States() {
+		var attrs []string
+		if def.IsTerminal(s) {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if s == current {
+			attrs = append(attrs, `style="rounded,filled"`, "fillcolor=gold")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "\t%s [%s];\n", dotQuote(s), strings.Join(attrs, ", "))
+		}
+	}
+
+	for _, t := range def.Transitions() {
+		fmt.Fprintf(&b, "\t%s -> %s [label=%s];\n", dotQuote(t.From), dotQuote(t.To), dotQuote(transitionLabel(t)))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid 导出 Mermaid stateDiagram-v2 格式
+// 状态使用 s0、s1... 作为 id，避免状态名和 Mermaid 关键字（例如 end）冲突
+func Mermaid(def *Definition, current string) string {
+	ids := map[string]string{}
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+	for i, s := range def.States() {
+		ids[s] = fmt.Sprintf("s%d", i)
+		fmt.Fprintf(&b, "\tstate \"%s\" as %s\n", mermaidEscape(s), ids[s])
+	}
+
+	fmt.Fprintf(&b, "\t[*] --> %s\n", ids[def.Initial()])
+	for _, t := range def.Transitions() {
+		fmt.Fprintf(&b, "\t%s --> %s : %s\n", ids[t.From], ids[t.To], mermaidEscape(transitionLabel(t)))
+	}
+	for _, s := range def.States() {
+		if def.IsTerminal(s) {
+			fmt.Fprintf(&b, "\t%s --> [*]\n", ids[s])
+		}
+	}
+
+	if id, ok := ids[current]; ok {
+		b.WriteString("\tclassDef current fill:gold,font-weight:bold\n")
+		fmt.Fprintf(&b, "\tclass %s current\n", id)
+	}
+	return b.String()
+}
+
+func transitionLabel(t Transition) string {
+	label := t.Event
+	switch {
+	case t.GuardName != "":
+		label += " [" + t.GuardName + "]"
+	case t.Guard != nil:
+		label += " [guard]"
+	}
+	switch {
+	case t.ActionName != "":
+		label += " / " + t.ActionName
+	case t.Action != nil:
+		label += " / action"
+	}
+	return label
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", ";", "#59;", "\n", " ").Replace(s)
+}
+
+func TestDiagram(t *testing.T) {
+	def, err := NewDefinition("leader", []Transition{
+		{From: "leader", Event: "approve", To: "finance", Guard: func(ctx *EventContext) bool { return true }, GuardName: "amount > 100"},
+		{From: "finance", Event: "approve", To: "end", Action: func(ctx *EventContext) error { return nil }, ActionName: "pay"},
+		{From: "finance", Event: "reject", To: "leader", Action: func(ctx *EventContext) error { return nil }},
+	}, WithTerminal("end"))
+	require.NoError(t, err)
+
+	assert.Equal(t, `digraph fsm {
+	rankdir=LR;
+	node [shape=box, style=rounded];
+	__start [shape=point];
+	__start -> "leader";
+	"finance" [style="rounded,filled", fillcolor=gold];
+	"end" [peripheries=2];
+	"leader" -> "finance" [label="approve [amount > 100]"];
+	"finance" -> "end" [label="approve / pay"];
+	"finance" -> "leader" [label="reject / action"];
+}
+`, DOT(def, "finance"))
+
+	assert.Equal(t, `stateDiagram-v2
+	state "leader" as s0
+	state "finance" as s1
+	state "end" as s2
+	[*] --> s0
+	s0 --> s1 : approve [amount > 100]
+	s1 --> s2 : approve / pay
+	s1 --> s0 : reject / action
+	s2 --> [*]
+	classDef current fill:gold,font-weight:bold
+	class s1 current
+`, Mermaid(def, "finance"))
+
+	// 不传当前状态时不高亮
+	assert.NotContains(t, Mermaid(def, ""), "classDef")
+}
@@ -0,0 +1,480 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 查表法实现的有限状态机
+// 状态、事件、守卫条件以及动作都声明在状态转移表中，状态机只负责查表和执行：
+// 守卫条件 -> 动作 -> 离开原状态(exit) -> 进入新状态(entry) -> 转移完成回调
+// 同一个状态、同一个事件可以声明多条转移，按照声明顺序选择第一条守卫条件通过的转移
+
+var (
+	// ErrInvalidEvent 当前状态不能处理该事件
+	ErrInvalidEvent = errors.New("invalid event")
+	// ErrGuardRejected 所有候选转移的守卫条件都没有通过
+	ErrGuardRejected = errors.New("guard rejected")
+)
+
+// EventContext 事件上下文，在守卫条件、动作以及钩子之间传递
+type EventContext struct {
+	Event string
+	From  string
+	To    string
+	Args  []interface{}
+	// In 判断状态当前是否处于激活状态，一般在守卫条件中使用
+	In func(state string) bool
+}
+
+// Guard 守卫条件，返回 true 才允许转移
+type Guard func(ctx *EventContext) bool
+
+// Action 转移动作，返回错误时转移终止，状态保持不变
+type Action func(ctx *EventContext) error
+
+// Hook 进入/离开状态以及转移完成时的回调
+type Hook func(ctx *EventContext)
+
+// Transition 状态转移表中的一行
+// GuardName、ActionName 是守卫条件和动作的描述，只用于校验和展示
+type Transition struct {
+	From       string
+	Event      string
+	To         string
+	Guard      Guard
+	Action     Action
+	GuardName  string
+	ActionName string
+}
+
+// DefinitionOption Definition 的可选参数
+type DefinitionOption struct {
+	entry        map[string][]Hook
+	exit         map[string][]Hook
+	onTransition []Hook
+	terminals    []string
+	timeouts     map[string][]timeout
+}
+
+type DefinitionOptFun func(option *DefinitionOption)
+
+// WithEntry 进入 state 时执行
+func WithEntry(state string, hook Hook) DefinitionOptFun {
+	return func(option *DefinitionOption) {
+		option.entry[state] = append(option.entry[state], hook)
+	}
+}
+
+// WithExit 离开 state 时执行
+func WithExit(state string, hook Hook) DefinitionOptFun {
+	return func(option *DefinitionOption) {
+		option.exit[state] = append(option.exit[state], hook)
+	}
+}
+
+// WithOnTransition 每次转移完成后执行
+func WithOnTransition(hook Hook) DefinitionOptFun {
+	return func(option *DefinitionOption) {
+		option.onTransition = append(option.onTransition, hook)
+	}
+}
+
+// WithTerminal 声明结束状态
+func WithTerminal(states ...string) DefinitionOptFun {
+	return func(option *DefinitionOption) {
+		option.terminals = append(option.terminals, states...)
+	}
+}
+
+// Definition 状态机定义，创建之后只读，可以被多个状态机实例共享
+type Definition struct {
+	initial     string
+	states      []string
+	transitions []Transition
+	// table 状态 -> 事件 -> 候选转移
+	table  map[string]map[string][]*Transition
+	option DefinitionOption
+}
+
+func NewDefinition(initial string, transitions []Transition, opts ...DefinitionOptFun) (*Definition, error) {
+	if initial == "" {
+		return nil, errors.New("initial state can not be empty")
+	}
+
+	option := DefinitionOption{
+		entry: map[string][]Hook{},
+		exit:  map[string][]Hook{},
+	}
+	for _, opt := range opts {
+		opt(&option)
+	}
+
+	d := &Definition{
+		initial:     initial,
+		transitions: make([]Transition, len(transitions)),
+		table:       map[string]map[string][]*Transition{},
+		option:      option,
+	}
+	copy(d.transitions, transitions)
+
+	seen := map[string]bool{}
+	addState := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			d.states = append(d.states, s)
+		}
+	}
+	addState(initial)
+
+	for i := range d.transitions {
+		t := &d.transitions[i]
+		if t.From == "" || t.Event == "" || t.To == "" {
+			return nil, fmt.Errorf("transition %d is invalid: from, event and to are required", i)
+		}
+		addState(t.From)
+		addState(t.To)
+
+		events, ok := d.table[t.From]
+		if !ok {
+			events = map[string][]*Transition{}
+			d.table[t.From] = events
+		}
+		events[t.Event] = append(events[t.Event], t)
+	}
+	for _, s := range option.terminals {
+		addState(s)
+	}
+	return d, nil
+}
+
+// Initial 初始状态
+func (d *Definition) Initial() string {
+	return d.initial
+}
+
+// States 按照声明顺序返回所有状态
+func (d *Definition) States() []string {
+	return append([]string(nil), d.states...)
+}
+
+// Transitions 按照声明顺序返回状态转移表
+func (d *Definition) Transitions() []Transition {
+	return append([]Transition(nil), d.transitions...)
+}
+
+// Events 返回 state 可以处理的事件，按字母序排列
+func (d *Definition) Events(state string) []string {
+	events := make([]string, 0, len(d.table[state]))
+	for e := range d.table[state] {
+		events = append(events, e)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// FSM 状态机实例，并发安全
+// 注意：不要在守卫条件、动作、钩子中调用同一个实例的 Fire，会造成死锁
+type FSM struct {
+	def     *Definition
+	lock    sync.Mutex
+	current string
+	option  FSMOption
+	// timers 当前状态的定时转移，epoch 在每次离开状态时加一，用于忽略已经过期的定时器回调
+	timers []Timer
+	epoch  uint64
+}
+
+// NewFSM 创建状态机实例，进入初始状态并执行初始状态的 entry 钩子
+func NewFSM(def *Definition, opts ...FSMOptFun) *FSM {
+	m := newFSM(def, def.initial, newFSMOption(opts))
+	m.start()
+	return m
+}
+
+// start 进入初始状态，执行 entry 钩子并启动定时器
+func (m *FSM) start() {
+	ctx := &EventContext{To: m.def.initial, In: m.in}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, hook := range m.def.option.entry[m.def.initial] {
+		hook(ctx)
+	}
+	m.schedule(0)
+}
+
+// RestoreFSM 从指定状态恢复状态机实例，不会执行 entry 钩子
+// 当前状态的定时转移从恢复时开始重新计时，使用 WithEnteredAt 指定进入时间时只计算剩余的时间
+func RestoreFSM(def *Definition, state string, opts ...FSMOptFun) (*FSM, error) {
+	return restoreFSM(def, state, newFSMOption(opts))
+}
+
+func restoreFSM(def *Definition, state string, option FSMOption) (*FSM, error) {
+	if !def.hasState(state) {
+		return nil, fmt.Errorf("unknown state: %s", state)
+	}
+	m := newFSM(def, state, option)
+
+	var elapsed time.Duration
+	if !option.enteredAt.IsZero() {
+		elapsed = option.clock.Now().Sub(option.enteredAt)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.schedule(elapsed)
+	return m, nil
+}
+
+func newFSMOption(opts []FSMOptFun) FSMOption {
+	option := FSMOption{
+		clock:   RealClock(),
+		onError: func(err error) {},
+	}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	return option
+}
+
+func newFSM(def *Definition, state string, option FSMOption) *FSM {
+	return &FSM{def: def, current: state, option: option}
+}
+
+// Definition 状态机定义
+func (m *FSM) Definition() *Definition {
+	return m.def
+}
+
+// Current 当前状态
+func (m *FSM) Current() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.current
+}
+
+// Can 当前状态是否可以处理事件（不考虑守卫条件）
+func (m *FSM) Can(event string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.def.table[m.current][event]) > 0
+}
+
+// Fire 触发事件
+func (m *FSM) Fire(event string, args ...interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.fire(event, args)
+}
+
+// Stop 取消所有未触发的定时转移，不再使用的状态机实例需要调用
+func (m *FSM) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cancelTimers()
+}
+
+// fire 调用方需要持有锁
+func (m *FSM) fire(event string, args []interface{}) error {
+	candidates := m.def.table[m.current][event]
+	if len(candidates) == 0 {
+		return fmt.Errorf("%w: state %s can not handle event %s", ErrInvalidEvent, m.current, event)
+	}
+
+	for _, t := range candidates {
+		ctx := &EventContext{Event: event, From: t.From, To: t.To, Args: args, In: m.in}
+		if t.Guard != nil && !t.Guard(ctx) {
+			continue
+		}
+		return m.transit(t, ctx)
+	}
+	return fmt.Errorf("%w: state %s event %s", ErrGuardRejected, m.current, event)
+}
+
+// in 调用方需要持有锁
+func (m *FSM) in(state string) bool {
+	return m.current == state
+}
+
+func (m *FSM) transit(t *Transition, ctx *EventContext) error {
+	if t.Action != nil {
+		if err := t.Action(ctx); err != nil {
+			return fmt.Errorf("action of %s -(%s)-> %s failed: %w", t.From, t.Event, t.To, err)
+		}
+	}
+
+	m.cancelTimers()
+	for _, hook := range m.def.option.exit[t.From] {
+		hook(ctx)
+	}
+	m.current = t.To
+	for _, hook := range m.def.option.entry[t.To] {
+		hook(ctx)
+	}
+	m.schedule(0)
+	for _, hook := range m.def.option.onTransition {
+		hook(ctx)
+	}
+	return nil
+}
+
+// IsTerminal 是否是声明的结束状态
+func (d *Definition) IsTerminal(state string) bool {
+	for _, s := range d.option.terminals {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate 校验状态机定义：
+// 1）必须声明结束状态，且结束状态不能有出边
+// 2）除结束状态外，每个状态都必须有出边
+// 3）所有状态都必须从初始状态可达
+// 4）不能有重复的转移（同一状态同一事件，守卫条件相同）
+func (d *Definition) Validate() error {
+	var errs []error
+	if len(d.option.terminals) == 0 {
+		errs = append(errs, errors.New("no terminal state declared"))
+	}
+
+	for _, s := range d.states {
+		switch {
+		case d.IsTerminal(s) && len(d.table[s]) > 0:
+			errs = append(errs, fmt.Errorf("terminal state %s has outgoing transitions", s))
+		case !d.IsTerminal(s) && len(d.table[s]) == 0:
+			errs = append(errs, fmt.Errorf("state %s has no outgoing transitions and is not terminal", s))
+		}
+	}
+
+	reachable := map[string]bool{d.initial: true}
+	queue := []string{d.initial}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, e := range d.Events(s) {
+			for _, t := range d.table[s][e] {
+				if !reachable[t.To] {
+					reachable[t.To] = true
+					queue = append(queue, t.To)
+				}
+			}
+		}
+	}
+	for _, s := range d.states {
+		if !reachable[s] {
+			errs = append(errs, fmt.Errorf("state %s is unreachable from %s", s, d.initial))
+		}
+	}
+
+	for _, state := range d.states {
+		for _, t := range d.option.timeouts[state] {
+			if len(d.table[state][t.event]) == 0 {
+				errs = append(errs, fmt.Errorf("state %s can not handle timeout event %s", state, t.event))
+			}
+		}
+	}
+
+	type key struct{ from, event, guard string }
+	seen := map[key]bool{}
+	for _, t := range d.transitions {
+		// 没有描述的守卫函数无法比较，跳过
+		if t.Guard != nil && t.GuardName == "" {
+			continue
+		}
+		k := key{t.From, t.Event, t.GuardName}
+		if seen[k] {
+			errs = append(errs, fmt.Errorf("duplicate transition: %s -(%s)-> %s guard %q", t.From, t.Event, t.To, t.GuardName))
+		}
+		seen[k] = true
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Definition) hasState(state string) bool {
+	for _, s := range d.states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFSM_Fire(t *testing.T) {
+	// 用状态转移表描述上面的报销审批流程：领导审批 -> 财务审批 -> 结束，金额超过 10000 需要总监审批
+	var logs []string
+	log := func(format string) Hook {
+		return func(ctx *EventContext) {
+			logs = append(logs, fmt.Sprintf(format, ctx.From, ctx.To))
+		}
+	}
+	large := func(ctx *EventContext) bool {
+		return len(ctx.Args) > 0 && ctx.Args[0].(int) > 10000
+	}
+	paid := 0
+
+	def, err := NewDefinition("leader", []Transition{
+		{From: "leader", Event: "approve", To: "director", Guard: large},
+		{From: "leader", Event: "approve", To: "finance"},
+		{From: "director", Event: "approve", To: "finance"},
+		{From: "director", Event: "reject", To: "leader"},
+		{From: "finance", Event: "approve", To: "end", Action: func(ctx *EventContext) error {
+			paid++
+			return nil
+		}},
+		{From: "finance", Event: "reject", To: "leader"},
+		{From: "finance", Event: "pay_failed", To: "end", Action: func(ctx *EventContext) error {
+			return errors.New("bank unavailable")
+		}},
+	},
+		WithExit("leader", log("exit %s -> %s")),
+		WithEntry("finance", log("entry %s -> %s")),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"leader", "director", "finance", "end"}, def.States())
+	assert.Equal(t, []string{"approve", "pay_failed", "reject"}, def.Events("finance"))
+
+	m := NewFSM(def)
+	assert.Equal(t, "leader", m.Current())
+	require.NoError(t, m.Fire("approve", 100))
+	assert.Equal(t, "finance", m.Current())
+	assert.Equal(t, []string{"exit leader -> finance", "entry leader -> finance"}, logs)
+
+	require.NoError(t, m.Fire("reject"))
+	require.NoError(t, m.Fire("approve", 20000))
+	assert.Equal(t, "director", m.Current())
+	require.NoError(t, m.Fire("approve"))
+
+	// 动作失败，状态不变
+	err = m.Fire("pay_failed")
+	assert.Error(t, err)
+	assert.Equal(t, "finance", m.Current())
+
+	require.NoError(t, m.Fire("approve"))
+	assert.Equal(t, "end", m.Current())
+	assert.Equal(t, 1, paid)
+
+	// 结束状态不能再处理任何事件
+	assert.False(t, m.Can("approve"))
+	assert.True(t, errors.Is(m.Fire("approve"), ErrInvalidEvent))
+
+	// 守卫条件全部拒绝
+	def, err = NewDefinition("a", []Transition{
+		{From: "a", Event: "go", To: "b", Guard: func(ctx *EventContext) bool { return false }},
+	})
+	require.NoError(t, err)
+	assert.True(t, errors.Is(NewFSM(def).Fire("go"), ErrGuardRejected))
+
+	_, err = NewDefinition("a", []Transition{{From: "a", To: "b"}})
+	assert.Error(t, err)
+	_, err = RestoreFSM(def, "unknown")
+	assert.Error(t, err)
+}
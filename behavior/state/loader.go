@@ -0,0 +1,309 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxmesh/gof-go/behavior/interpreter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// 从 YAML/JSON 文档加载状态机定义
+// 审批流程在不同部门之间会有差异，将状态、事件、守卫条件以及动作写在配置文档中，
+// 动作通过名字从 Registry 中查找，守卫条件使用 interpreter 包的告警规则语法，例如 "amount > 10000 && days < 30"
+// 守卫条件的变量取自 Fire 参数中第一个 map[string]float64
+
+// StateSpec 状态声明
+type StateSpec struct {
+	Name     string   `json:"name" yaml:"name"`
+	Terminal bool     `json:"terminal,omitempty" yaml:"terminal,omitempty"`
+	Entry    []string `json:"entry,omitempty" yaml:"entry,omitempty"`
+	Exit     []string `json:"exit,omitempty" yaml:"exit,omitempty"`
+}
+
+// TransitionSpec 转移声明
+type TransitionSpec struct {
+	From   string `json:"from" yaml:"from"`
+	Event  string `json:"event" yaml:"event"`
+	To     string `json:"to" yaml:"to"`
+	Guard  string `json:"guard,omitempty" yaml:"guard,omitempty"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+// Spec 状态机文档
+type Spec struct {
+	Name        string           `json:"name" yaml:"name"`
+	Initial     string           `json:"initial" yaml:"initial"`
+	States      []StateSpec      `json:"states" yaml:"states"`
+	Transitions []TransitionSpec `json:"transitions" yaml:"transitions"`
+}
+
+// Registry 动作和钩子的注册表
+type Registry struct {
+	actions map[string]Action
+	hooks   map[string]Hook
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		actions: map[string]Action{},
+		hooks:   map[string]Hook{},
+	}
+}
+
+// RegisterAction 注册转移动作
+func (r *Registry) RegisterAction(name string, action Action) {
+	r.actions[name] = action
+}
+
+// RegisterHook 注册 entry/exit 钩子
+func (r *Registry) RegisterHook(name string, hook Hook) {
+	r.hooks[name] = hook
+}
+
+// Build 根据文档创建状态机定义，并进行校验
+func (s *Spec) Build(registry *Registry) (*Definition, error) {
+	if registry == nil {
+		registry = NewRegistry()
+	}
+
+	var errs []error
+	declared := map[string]bool{}
+	var opts []DefinitionOptFun
+	for _, st := range s.States {
+		if st.Name == "" {
+			errs = append(errs, errors.New("state name can not be empty"))
+			continue
+		}
+		if declared[st.Name] {
+			errs = append(errs, fmt.Errorf("duplicate state: %s", st.Name))
+		}
+		declared[st.Name] = true
+
+		if st.Terminal {
+			opts = append(opts, WithTerminal(st.Name))
+		}
+		for _, name := range st.Entry {
+			hook, ok := registry.hooks[name]
+			if !ok {
+				errs = append(errs, fmt.Errorf("state %s: hook not found: %s", st.Name, name))
+				continue
+			}
+			opts = append(opts, WithEntry(st.Name, hook))
+		}
+		for _, name := range st.Exit {
+			hook, ok := registry.hooks[name]
+			if !ok {
+				errs = append(errs, fmt.Errorf("state %s: hook not found: %s", st.Name, name))
+				continue
+			}
+			opts = append(opts, WithExit(st.Name, hook))
+		}
+	}
+	if !declared[s.Initial] {
+		errs = append(errs, fmt.Errorf("initial state is not declared: %q", s.Initial))
+	}
+
+	transitions := make([]Transition, 0, len(s.Transitions))
+	for i, ts := range s.Transitions {
+		for _, name := range []string{ts.From, ts.To} {
+			if !declared[name] {
+				errs = append(errs, fmt.Errorf("transition %d: state is not declared: %q", i, name))
+			}
+		}
+
+		t := Transition{From: ts.From, Event: ts.Event, To: ts.To, GuardName: ts.Guard, ActionName: ts.Action}
+		if ts.Guard != "" {
+			guard, err := compileGuard(ts.Guard)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("transition %d: %w", i, err))
+			}
+			t.Guard = guard
+		}
+		if ts.Action != "" {
+			action, ok := registry.actions[ts.Action]
+			if !ok {
+				errs = append(errs, fmt.Errorf("transition %d: action not found: %s", i, ts.Action))
+			}
+			t.Action = action
+		}
+		transitions = append(transitions, t)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	def, err := NewDefinition(s.Initial, transitions, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// 状态只出现在 states 中而没有出现在转移表中时，也需要校验到
+	for _, st := range s.States {
+		if !def.hasState(st.Name) {
+			def.states = append(def.states, st.Name)
+		}
+	}
+	if err := def.Validate(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// LoadJSON 从 JSON 文档加载状态机定义
+func LoadJSON(data []byte, registry *Registry) (*Definition, error) {
+	var spec Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse json failed: %w", err)
+	}
+	return spec.Build(registry)
+}
+
+// LoadYAML 从 YAML 文档加载状态机定义
+func LoadYAML(data []byte, registry *Registry) (*Definition, error) {
+	var spec Spec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse yaml failed: %w", err)
+	}
+	return spec.Build(registry)
+}
+
+// LoadFile 根据扩展名（.json/.yaml/.yml）加载状态机定义
+func LoadFile(name string, registry *Registry) (*Definition, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(name) {
+	case ".json":
+		return LoadJSON(data, registry)
+	case ".yaml", ".yml":
+		return LoadYAML(data, registry)
+	default:
+		return nil, fmt.Errorf("unsupported definition file: %s", name)
+	}
+}
+
+func compileGuard(exp string) (Guard, error) {
+	rule, err := interpreter.NewAlertRule(exp)
+	if err != nil {
+		return nil, fmt.Errorf("guard %q is invalid: %w", exp, err)
+	}
+	return func(ctx *EventContext) bool {
+		for _, arg := range ctx.Args {
+			if vars, ok := arg.(map[string]float64); ok {
+				return rule.Interpret(vars)
+			}
+		}
+		return false
+	}, nil
+}
+
+func TestLoadYAML(t *testing.T) {
+	doc := `
+name: reimburse
+initial: leader
+states:
+  - name: leader
+    exit: [log]
+  - name: director
+  - name: finance
+    entry: [log]
+  - name: end
+    terminal: true
+transitions:
+  - {from: leader, event: approve, to: director, guard: "amount > 10000"}
+  - {from: leader, event: approve, to: finance}
+  - {from: director, event: approve, to: finance}
+  - {from: director, event: reject, to: leader}
+  - {from: finance, event: approve, to: end, action: pay}
+  - {from: finance, event: reject, to: leader}
+`
+	var logs []string
+	paid := 0
+	registry := NewRegistry()
+	registry.RegisterHook("log", func(ctx *EventContext) {
+		logs = append(logs, ctx.From+"->"+ctx.To)
+	})
+	registry.RegisterAction("pay", func(ctx *EventContext) error {
+		paid++
+		return nil
+	})
+
+	def, err := LoadYAML([]byte(doc), registry)
+	require.NoError(t, err)
+
+	m := NewFSM(def)
+	require.NoError(t, m.Fire("approve", map[string]float64{"amount": 20000}))
+	assert.Equal(t, "director", m.Current())
+	require.NoError(t, m.Fire("approve"))
+	require.NoError(t, m.Fire("approve"))
+	assert.Equal(t, "end", m.Current())
+	assert.Equal(t, 1, paid)
+	assert.Equal(t, []string{"leader->director", "director->finance"}, logs)
+
+	// 同一份定义也可以用 JSON 描述，写到文件中加载
+	name := filepath.Join(t.TempDir(), "reimburse.json")
+	require.NoError(t, os.WriteFile(name, []byte(`{
+		"initial": "leader",
+		"states": [{"name": "leader"}, {"name": "finance"}, {"name": "end", "terminal": true}],
+		"transitions": [
+			{"from": "leader", "event": "approve", "to": "finance"},
+			{"from": "finance", "event": "approve", "to": "end", "action": "pay"}
+		]
+	}`), 0644))
+	def, err = LoadFile(name, registry)
+	require.NoError(t, err)
+	m = NewFSM(def)
+	require.NoError(t, m.Fire("approve"))
+	require.NoError(t, m.Fire("approve"))
+	assert.Equal(t, 2, paid)
+}
+
+func TestSpec_Build(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{
+			name: "unreachable",
+			doc: `{"initial": "a", "states": [{"name": "a"}, {"name": "b"}, {"name": "c", "terminal": true}],
+				"transitions": [{"from": "a", "event": "go", "to": "c"}, {"from": "b", "event": "go", "to": "c"}]}`,
+			want: []string{"state b is unreachable from a"},
+		},
+		{
+			name: "missing terminal",
+			doc: `{"initial": "a", "states": [{"name": "a"}, {"name": "b"}],
+				"transitions": [{"from": "a", "event": "go", "to": "b"}]}`,
+			want: []string{"no terminal state declared", "state b has no outgoing transitions and is not terminal"},
+		},
+		{
+			name: "duplicate",
+			doc: `{"initial": "a", "states": [{"name": "a"}, {"name": "b", "terminal": true}],
+				"transitions": [{"from": "a", "event": "go", "to": "b"}, {"from": "a", "event": "go", "to": "b"}]}`,
+			want: []string{`duplicate transition: a -(go)-> b guard ""`},
+		},
+		{
+			name: "undeclared",
+			doc: `{"initial": "a", "states": [{"name": "a"}, {"name": "b", "terminal": true}],
+				"transitions": [{"from": "a", "event": "go", "to": "x", "guard": "n ~ 1", "action": "unknown"}]}`,
+			want: []string{`transition 0: state is not declared: "x"`, `guard "n ~ 1" is invalid`, "action not found: unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadJSON([]byte(tt.doc), nil)
+			require.Error(t, err)
+			for _, want := range tt.want {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 层次状态机（statechart）
+// 真实的流程中会有子流程，例如财务审批内部包含“发票检查”和“预算检查”两个并行的子流程
+// 1）嵌套状态：复合状态包含子状态，处于子状态时同时也处于父状态，子状态没有处理的事件交给父状态处理
+// 2）并行状态：并行状态的每个子状态是一个正交区域，进入并行状态时同时进入所有区域
+// 3）历史状态：复合状态声明了历史后，再次进入时恢复到上次离开时的子状态（浅历史只恢复直接子状态，深历史恢复全部后代状态）
+//
+// 事件分发规则（保证确定性）：
+// 1）按照状态声明顺序（先序遍历）遍历所有激活的原子状态
+// 2）对每个原子状态，从自身开始向上查找第一个有可用转移的状态，同一状态按转移声明顺序选择第一条守卫通过的转移
+// 3）多条被选中的转移如果需要离开的状态有重叠，则源状态更深的优先，否则先选中的优先
+// 4）先执行所有动作，任意动作失败则状态保持不变；然后离开状态（由深到浅），最后进入状态（由浅到深）
+// 转移的作用域是源状态和目标状态最近的公共复合祖先，作用域内激活的状态全部离开，自转移会离开并重新进入自身
+
+// HistoryType 历史类型
+type HistoryType int
+
+const (
+	NoHistory HistoryType = iota
+	ShallowHistory
+	DeepHistory
+)
+
+// ChartState 状态声明，有子状态的是复合状态或并行状态，没有子状态的是原子状态
+type ChartState struct {
+	Name string
+	// Initial 复合状态的初始子状态，默认是第一个子状态
+	Initial  string
+	Parallel bool
+	History  HistoryType
+	Children []ChartState
+}
+
+type chartNode struct {
+	name        string
+	parent      *chartNode
+	children    []*chartNode
+	initial     *chartNode
+	parallel    bool
+	history     HistoryType
+	depth       int
+	order       int
+	transitions map[string][]*Transition
+}
+
+func (n *chartNode) isDescendantOf(ancestor *chartNode) bool {
+	for p := n.parent; p != nil; p = p.parent {
+		if p == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// ChartDefinition 层次状态机定义，顶层状态的初始状态是第一个顶层状态
+type ChartDefinition struct {
+	root        *chartNode
+	nodes       map[string]*chartNode
+	order       []*chartNode
+	transitions []Transition
+	option      DefinitionOption
+}
+
+func NewChartDefinition(states []ChartState, transitions []Transition, opts ...DefinitionOptFun) (*ChartDefinition, error) {
+	if len(states) == 0 {
+		return nil, errors.New("states can not be empty")
+	}
+
+	option := DefinitionOption{
+		entry: map[string][]Hook{},
+		exit:  map[string][]Hook{},
+	}
+	for _, opt := range opts {
+		opt(&option)
+	}
+
+	d := &ChartDefinition{
+		nodes:       map[string]*chartNode{},
+		transitions: make([]Transition, len(transitions)),
+		option:      option,
+	}
+	copy(d.transitions, transitions)
+
+	d.root = &chartNode{transitions: map[string][]*Transition{}}
+	if err := d.build(d.root, ChartState{Children: states}); err != nil {
+		return nil, err
+	}
+
+	for i := range d.transitions {
+		t := &d.transitions[i]
+		from, ok := d.nodes[t.From]
+		if !ok || t.Event == "" {
+			return nil, fmt.Errorf("transition %d is invalid: unknown state %q or empty event", i, t.From)
+		}
+		if _, ok := d.nodes[t.To]; !ok {
+			return nil, fmt.Errorf("transition %d is invalid: unknown state %q", i, t.To)
+		}
+		from.transitions[t.Event] = append(from.transitions[t.Event], t)
+	}
+	return d, nil
+}
+
+func (d *ChartDefinition) build(n *chartNode, s ChartState) error {
+	for _, cs := range s.Children {
+		if cs.Name == "" {
+			return errors.New("state name can not be empty")
+		}
+		if _, ok := d.nodes[cs.Name]; ok {
+			return fmt.Errorf("duplicate state: %s", cs.Name)
+		}
+		if cs.Parallel && cs.Initial != "" {
+			return fmt.Errorf("parallel state %s can not declare initial", cs.Name)
+		}
+		// 并行状态的所有区域都会进入，没有需要记住的子状态，历史由各个区域自己声明
+		if cs.Parallel && cs.History != NoHistory {
+			return fmt.Errorf("parallel state %s can not declare history", cs.Name)
+		}
+
+		child := &chartNode{
+			name:        cs.Name,
+			parent:      n,
+			parallel:    cs.Parallel,
+			history:     cs.History,
+			depth:       n.depth + 1,
+			order:       len(d.order),
+			transitions: map[string][]*Transition{},
+		}
+		d.nodes[cs.Name] = child
+		d.order = append(d.order, child)
+		n.children = append(n.children, child)
+
+		if err := d.build(child, cs); err != nil {
+			return err
+		}
+	}
+
+	if len(n.children) == 0 {
+		return nil
+	}
+	n.initial = n.children[0]
+	if s.Initial != "" {
+		n.initial = nil
+		for _, c := range n.children {
+			if c.name == s.Initial {
+				n.initial = c
+			}
+		}
+		if n.initial == nil {
+			return fmt.Errorf("initial %s is not a child of %s", s.Initial, s.Name)
+		}
+	}
+	return nil
+}
+
+// domain 转移的作用域：源状态和目标状态最近的公共复合祖先（不包含源状态自身）
+func (d *ChartDefinition) domain(source, target *chartNode) *chartNode {
+	for a := source.parent; a != nil; a = a.parent {
+		if !a.parallel && (a == d.root || target.isDescendantOf(a)) {
+			return a
+		}
+	}
+	return d.root
+}
+
+// Chart 层次状态机实例，并发安全
+type Chart struct {
+	def    *ChartDefinition
+	lock   sync.Mutex
+	active map[*chartNode]bool
+	// history 复合状态离开时激活的后代状态
+	history map[*chartNode]map[*chartNode]bool
+}
+
+// NewChart 创建实例并进入初始状态
+func NewChart(def *ChartDefinition) *Chart {
+	c := &Chart{
+		def:     def,
+		active:  map[*chartNode]bool{},
+		history: map[*chartNode]map[*chartNode]bool{},
+	}
+	c.active[def.root] = true
+	c.enter(def.root.initial, nil, nil, &EventContext{To: def.root.initial.name, In: c.in})
+	return c
+}
+
+// Active 按声明顺序返回所有激活的状态
+func (c *Chart) Active() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var states []string
+	for _, n := range c.def.order {
+		if c.active[n] {
+			states = append(states, n.name)
+		}
+	}
+	return states
+}
+
+// IsActive 状态是否处于激活状态
+func (c *Chart) IsActive(state string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.in(state)
+}
+
+type selection struct {
+	t      *Transition
+	source *chartNode
+	domain *chartNode
+	exits  []*chartNode
+	ctx    *EventContext
+}
+
+// Fire 触发事件，分发规则见文件开头的说明
+func (c *Chart) Fire(event string, args ...interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var selected []*selection
+	found := false
+	for _, leaf := range c.def.order {
+		if !c.active[leaf] || len(leaf.children) > 0 {
+			continue
+		}
+
+		for n := leaf; n != c.def.root; n = n.parent {
+			var picked *selection
+			for _, t := range n.transitions[event] {
+				found = true
+				ctx := &EventContext{Event: event, From: t.From, To: t.To, Args: args, In: c.in}
+				if t.Guard == nil || t.Guard(ctx) {
+					picked = &selection{t: t, source: n, ctx: ctx}
+					break
+				}
+			}
+			if picked != nil {
+				selected = c.add(selected, picked)
+				break
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		if found {
+			return fmt.Errorf("%w: active %v event %s", ErrGuardRejected, c.activeNames(), event)
+		}
+		return fmt.Errorf("%w: active %v can not handle event %s", ErrInvalidEvent, c.activeNames(), event)
+	}
+
+	for _, s := range selected {
+		if s.t.Action == nil {
+			continue
+		}
+		if err := s.t.Action(s.ctx); err != nil {
+			return fmt.Errorf("action of %s -(%s)-> %s failed: %w", s.t.From, s.t.Event, s.t.To, err)
+		}
+	}
+
+	for _, s := range selected {
+		for _, n := range s.exits {
+			if n.history != NoHistory {
+				c.history[n] = c.descendants(n)
+			}
+		}
+		for _, n := range s.exits {
+			for _, hook := range c.def.option.exit[n.name] {
+				hook(s.ctx)
+			}
+			delete(c.active, n)
+		}
+	}
+
+	for _, s := range selected {
+		target := c.def.nodes[s.t.To]
+		var path []*chartNode
+		for n := target; n != s.domain; n = n.parent {
+			path = append([]*chartNode{n}, path...)
+		}
+		c.enter(path[0], path[1:], nil, s.ctx)
+		for _, hook := range c.def.option.onTransition {
+			hook(s.ctx)
+		}
+	}
+	return nil
+}
+
+// add 加入被选中的转移，处理冲突
+func (c *Chart) add(selected []*selection, s *selection) []*selection {
+	s.domain = c.def.domain(s.source, c.def.nodes[s.t.To])
+	for n := range c.active {
+		if n.isDescendantOf(s.domain) {
+			s.exits = append(s.exits, n)
+		}
+	}
+	// 由深到浅离开，同一深度按照声明顺序的逆序
+	sort.Slice(s.exits, func(i, j int) bool {
+		if s.exits[i].depth != s.exits[j].depth {
+			return s.exits[i].depth > s.exits[j].depth
+		}
+		return s.exits[i].order > s.exits[j].order
+	})
+
+	for i, o := range selected {
+		if o.t == s.t {
+			return selected
+		}
+		if !intersect(o.exits, s.exits) {
+			continue
+		}
+		if s.source.isDescendantOf(o.source) {
+			selected[i] = s
+		}
+		return selected
+	}
+	return append(selected, s)
+}
+
+// enter 进入状态 n，path 是需要进入的后代路径，restore 是深历史需要恢复的状态
+func (c *Chart) enter(n *chartNode, path []*chartNode, restore map[*chartNode]bool, ctx *EventContext) {
+	c.active[n] = true
+	for _, hook := range c.def.option.entry[n.name] {
+		hook(ctx)
+	}
+	if len(n.children) == 0 {
+		return
+	}
+
+	if n.parallel {
+		for _, child := range n.children {
+			if len(path) > 0 && path[0] == child {
+				c.enter(child, path[1:], nil, ctx)
+			} else {
+				c.enter(child, nil, restore, ctx)
+			}
+		}
+		return
+	}
+
+	if len(path) > 0 {
+		c.enter(path[0], path[1:], nil, ctx)
+		return
+	}
+
+	remembered := restore
+	if remembered == nil {
+		remembered = c.history[n]
+		if n.history == ShallowHistory {
+			restore = nil
+		} else {
+			restore = remembered
+		}
+	}
+	child := n.initial
+	for _, ch := range n.children {
+		if remembered[ch] {
+			child = ch
+		}
+	}
+	c.enter(child, nil, restore, ctx)
+}
+
+func (c *Chart) descendants(n *chartNode) map[*chartNode]bool {
+	set := map[*chartNode]bool{}
+	for a := range c.active {
+		if a.isDescendantOf(n) {
+			set[a] = true
+		}
+	}
+	return set
+}
+
+// in 调用方需要持有锁
+func (c *Chart) in(state string) bool {
+	n, ok := c.def.nodes[state]
+	return ok && c.active[n]
+}
+
+func (c *Chart) activeNames() []string {
+	var states []string
+	for _, n := range c.def.order {
+		if c.active[n] {
+			states = append(states, n.name)
+		}
+	}
+	return states
+}
+
+func intersect(a, b []*chartNode) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newFinanceChart 财务审批包含发票检查和预算检查两个并行区域，两个都通过之后才能结束
+func newFinanceChart(t *testing.T, logs *[]string) *ChartDefinition {
+	log := func(prefix string) Hook {
+		return func(ctx *EventContext) {
+			*logs = append(*logs, prefix+":"+ctx.Event)
+		}
+	}
+	def, err := NewChartDefinition([]ChartState{
+		{Name: "leader"},
+		{Name: "finance", Parallel: true, Children: []ChartState{
+			{Name: "invoice", Children: []ChartState{{Name: "invoice_checking"}, {Name: "invoice_ok"}}},
+			{Name: "budget", Children: []ChartState{{Name: "budget_checking"}, {Name: "budget_ok"}}},
+		}},
+		{Name: "end"},
+	}, []Transition{
+		{From: "leader", Event: "approve", To: "finance"},
+		{From: "invoice_checking", Event: "pass", To: "invoice_ok"},
+		{From: "budget_checking", Event: "pass", To: "budget_ok"},
+		{From: "finance", Event: "reject", To: "leader"},
+		{From: "finance", Event: "approve", To: "end", Guard: func(ctx *EventContext) bool {
+			return ctx.In("invoice_ok") && ctx.In("budget_ok")
+		}},
+	},
+		WithEntry("finance", log("entry finance")),
+		WithExit("finance", log("exit finance")),
+		WithExit("invoice_checking", log("exit invoice_checking")),
+		WithExit("budget_checking", log("exit budget_checking")),
+	)
+	require.NoError(t, err)
+	return def
+}
+
+func TestChart_Parallel(t *testing.T) {
+	var logs []string
+	c := NewChart(newFinanceChart(t, &logs))
+	assert.Equal(t, []string{"leader"}, c.Active())
+
+	require.NoError(t, c.Fire("approve"))
+	assert.Equal(t, []string{"finance", "invoice", "invoice_checking", "budget", "budget_checking"}, c.Active())
+
+	// 两个区域都还在检查，不能结束
+	assert.True(t, errors.Is(c.Fire("approve"), ErrGuardRejected))
+
+	// 同一个事件被两个区域同时处理，按照声明顺序离开
+	logs = nil
+	require.NoError(t, c.Fire("pass"))
+	assert.Equal(t, []string{"exit invoice_checking:pass", "exit budget_checking:pass"}, logs)
+	assert.Equal(t, []string{"finance", "invoice", "invoice_ok", "budget", "budget_ok"}, c.Active())
+
+	require.NoError(t, c.Fire("approve"))
+	assert.Equal(t, []string{"end"}, c.Active())
+	assert.True(t, errors.Is(c.Fire("approve"), ErrInvalidEvent))
+}
+
+func TestChart_Nested(t *testing.T) {
+	var logs []string
+	c := NewChart(newFinanceChart(t, &logs))
+	require.NoError(t, c.Fire("approve"))
+
+	// 原子状态没有处理 reject，由父状态 finance 处理，由深到浅、同一深度按声明顺序的逆序离开所有子状态
+	logs = nil
+	require.NoError(t, c.Fire("reject"))
+	assert.Equal(t, []string{"leader"}, c.Active())
+	assert.Equal(t, []string{"exit budget_checking:reject", "exit invoice_checking:reject", "exit finance:reject"}, logs)
+
+	// 子状态的转移优先于父状态
+	def, err := NewChartDefinition([]ChartState{
+		{Name: "parent", Children: []ChartState{{Name: "a"}, {Name: "b"}}},
+		{Name: "other"},
+	}, []Transition{
+		{From: "parent", Event: "next", To: "other"},
+		{From: "a", Event: "next", To: "b"},
+		{From: "b", Event: "self", To: "b"},
+	}, WithEntry("b", func(ctx *EventContext) { logs = append(logs, "entry b:"+ctx.Event) }))
+	require.NoError(t, err)
+	c = NewChart(def)
+	require.NoError(t, c.Fire("next"))
+	assert.Equal(t, []string{"parent", "b"}, c.Active())
+
+	// 自转移会重新进入
+	logs = nil
+	require.NoError(t, c.Fire("self"))
+	assert.Equal(t, []string{"entry b:self"}, logs)
+
+	require.NoError(t, c.Fire("next"))
+	assert.Equal(t, []string{"other"}, c.Active())
+
+	_, err = NewChartDefinition([]ChartState{{Name: "a"}, {Name: "a"}}, nil)
+	assert.Error(t, err)
+	_, err = NewChartDefinition([]ChartState{{Name: "a", Initial: "x", Children: []ChartState{{Name: "b"}}}}, nil)
+	assert.Error(t, err)
+	_, err = NewChartDefinition([]ChartState{{Name: "p", Parallel: true, History: DeepHistory, Children: []ChartState{{Name: "b"}}}}, nil)
+	assert.EqualError(t, err, "parallel state p can not declare history")
+}
+
+func TestChart_History(t *testing.T) {
+	states := func(history HistoryType) []ChartState {
+		return []ChartState{
+			{Name: "editing", History: history, Children: []ChartState{
+				{Name: "draft"},
+				{Name: "review", Children: []ChartState{{Name: "first"}, {Name: "second"}}},
+			}},
+			{Name: "paused"},
+		}
+	}
+	transitions := []Transition{
+		{From: "draft", Event: "submit", To: "review"},
+		{From: "first", Event: "next", To: "second"},
+		{From: "editing", Event: "pause", To: "paused"},
+		{From: "paused", Event: "resume", To: "editing"},
+	}
+
+	tests := []struct {
+		name    string
+		history HistoryType
+		want    []string
+	}{
+		{name: "none", history: NoHistory, want: []string{"editing", "draft"}},
+		{name: "shallow", history: ShallowHistory, want: []string{"editing", "review", "first"}},
+		{name: "deep", history: DeepHistory, want: []string{"editing", "review", "second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, err := NewChartDefinition(states(tt.history), transitions)
+			require.NoError(t, err)
+			c := NewChart(def)
+			require.NoError(t, c.Fire("submit"))
+			require.NoError(t, c.Fire("next"))
+			require.NoError(t, c.Fire("pause"))
+			assert.Equal(t, []string{"paused"}, c.Active())
+			require.NoError(t, c.Fire("resume"))
+			assert.Equal(t, tt.want, c.Active())
+		})
+	}
+}
+
+func TestChart_Conflict(t *testing.T) {
+	// 两个区域同时响应 go：左边区域要离开整个并行状态，右边区域只在内部转移
+	// 两者离开的状态有重叠，源状态深度相同，先声明的左边区域优先
+	def, err := NewChartDefinition([]ChartState{
+		{Name: "p", Parallel: true, Children: []ChartState{
+			{Name: "left", Children: []ChartState{{Name: "l1"}}},
+			{Name: "right", Children: []ChartState{{Name: "r1"}, {Name: "r2"}}},
+		}},
+		{Name: "out"},
+	}, []Transition{
+		{From: "l1", Event: "go", To: "out"},
+		{From: "r1", Event: "go", To: "r2"},
+		// 父状态的转移被更深的源状态抢占
+		{From: "p", Event: "stay", To: "out"},
+		{From: "r1", Event: "stay", To: "r2"},
+	})
+	require.NoError(t, err)
+
+	c := NewChart(def)
+	require.NoError(t, c.Fire("go"))
+	assert.Equal(t, []string{"out"}, c.Active())
+
+	c = NewChart(def)
+	require.NoError(t, c.Fire("stay"))
+	assert.Equal(t, []string{"p", "left", "l1", "right", "r2"}, c.Active())
+}
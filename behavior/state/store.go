@@ -0,0 +1,438 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 持久化的状态机实例
+// 一个审批单会持续好几天，状态机实例需要保存下来：当前状态、每一次转移的审计记录（事件、操作人、时间、备注）
+// 使用版本号实现乐观锁，两个请求同时基于同一个版本恢复实例时，后提交的会得到 ErrConflict
+
+var (
+	// ErrNotFound 实例不存在
+	ErrNotFound = errors.New("instance not found")
+	// ErrConflict 实例已经被其他人修改
+	ErrConflict = errors.New("instance version conflict")
+)
+
+// Record 一次状态转移的审计记录
+type Record struct {
+	Event   string    `json:"event"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Actor   string    `json:"actor"`
+	Comment string    `json:"comment,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Instance 持久化的状态机实例
+type Instance struct {
+	ID      string    `json:"id"`
+	State   string    `json:"state"`
+	Version int64     `json:"version"`
+	Created time.Time `json:"created"`
+	History []Record  `json:"history"`
+}
+
+func (i *Instance) clone() *Instance {
+	c := *i
+	c.History = append([]Record(nil), i.History...)
+	return &c
+}
+
+// Store 状态机实例存储
+type Store interface {
+	// Load 加载实例，不存在时返回 ErrNotFound
+	Load(id string) (*Instance, error)
+	// Save 保存实例，存储中的版本必须和 instance.Version 一致（新实例为 0），否则返回 ErrConflict
+	// 保存成功后 instance.Version 加一
+	Save(instance *Instance) error
+}
+
+// MemoryStore 内存存储，一般用于测试
+type MemoryStore struct {
+	lock      sync.Mutex
+	instances map[string]*Instance
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{instances: map[string]*Instance{}}
+}
+
+func (s *MemoryStore) Load(id string) (*Instance, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return i.clone(), nil
+}
+
+func (s *MemoryStore) Save(instance *Instance) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var version int64
+	if old, ok := s.instances[instance.ID]; ok {
+		version = old.Version
+	}
+	if version != instance.Version {
+		return fmt.Errorf("%w: %s expect version %d, got %d", ErrConflict, instance.ID, version, instance.Version)
+	}
+
+	instance.Version++
+	s.instances[instance.ID] = instance.clone()
+	return nil
+}
+
+// FileStore 文件存储，每个实例保存为目录下的一个 JSON 文件
+// 版本校验只在当前进程内加锁，多个进程共享同一个目录时需要外部的锁
+type FileStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Load(id string) (*Instance, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.load(id)
+}
+
+func (s *FileStore) Save(instance *Instance) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var version int64
+	old, err := s.load(instance.ID)
+	switch {
+	case err == nil:
+		version = old.Version
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+	if version != instance.Version {
+		return fmt.Errorf("%w: %s expect version %d, got %d", ErrConflict, instance.ID, version, instance.Version)
+	}
+
+	saved := instance.clone()
+	saved.Version++
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名，避免写到一半留下损坏的文件
+	name, _ := s.path(instance.ID)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	instance.Version = saved.Version
+	return nil
+}
+
+func (s *FileStore) load(id string) (*Instance, error) {
+	name, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var i Instance
+	if err := json.Unmarshal(data, &i); err != nil {
+		return nil, fmt.Errorf("instance %s is corrupted: %w", id, err)
+	}
+	return &i, nil
+}
+
+func (s *FileStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid instance id: %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// SystemActor 定时转移等自动触发的事件在审计记录中的操作人
+const SystemActor = "system"
+
+// Workflow 与存储绑定的状态机实例
+// 定时转移也通过 Fire 触发，操作人为 SystemActor，和人工操作一样会保存并写入审计记录
+type Workflow struct {
+	lock     sync.Mutex
+	fsm      *FSM
+	store    Store
+	instance *Instance
+	option   FSMOption
+}
+
+func newWorkflow(store Store, opts []FSMOptFun) *Workflow {
+	w := &Workflow{store: store, option: newFSMOption(opts)}
+	w.option.dispatch = w.fireTimeout
+	return w
+}
+
+// StartWorkflow 创建新的实例并保存，id 已存在时返回 ErrConflict
+func StartWorkflow(def *Definition, store Store, id string, opts ...FSMOptFun) (*Workflow, error) {
+	w := newWorkflow(store, opts)
+	instance := &Instance{ID: id, State: def.Initial(), Created: w.option.clock.Now()}
+	if err := store.Save(instance); err != nil {
+		return nil, err
+	}
+	w.instance = instance
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.fsm = newFSM(def, def.Initial(), w.option)
+	w.fsm.start()
+	return w, nil
+}
+
+// ResumeWorkflow 从存储中恢复实例，当前状态的定时转移从最后一次转移的时间开始计算剩余时间
+func ResumeWorkflow(def *Definition, store Store, id string, opts ...FSMOptFun) (*Workflow, error) {
+	instance, err := store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	w := newWorkflow(store, opts)
+	w.instance = instance
+	fsm, err := w.restore(def, instance.State)
+	if err != nil {
+		return nil, err
+	}
+	w.fsm = fsm
+	return w, nil
+}
+
+// restore 按照审计记录计算进入当前状态的时间并恢复状态机
+func (w *Workflow) restore(def *Definition, state string) (*FSM, error) {
+	option := w.option
+	option.enteredAt = w.instance.Created
+	if n := len(w.instance.History); n > 0 {
+		option.enteredAt = w.instance.History[n-1].Time
+	}
+	return restoreFSM(def, state, option)
+}
+
+// ID 实例 ID
+func (w *Workflow) ID() string {
+	return w.instance.ID
+}
+
+// Current 当前状态
+func (w *Workflow) Current() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.fsm.Current()
+}
+
+// Version 当前版本号
+func (w *Workflow) Version() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.instance.Version
+}
+
+// History 审计记录
+func (w *Workflow) History() []Record {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]Record(nil), w.instance.History...)
+}
+
+// Stop 取消所有未触发的定时转移，不再使用的实例需要调用
+func (w *Workflow) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.fsm.Stop()
+}
+
+// Fire 触发事件并保存审计记录
+// 触发前会检查存储中的版本，已被其他人修改时返回 ErrConflict 且不会执行转移，调用方需要重新 ResumeWorkflow
+// 极端情况下检查之后、保存之前被修改，状态会回滚，但转移动作已经执行，动作需要自己保证幂等
+func (w *Workflow) Fire(event, actor, comment string, args ...interface{}) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.fire(event, actor, comment, args)
+}
+
+// fireTimeout 定时器到期，调用方不能持有锁
+func (w *Workflow) fireTimeout(m *FSM, epoch uint64, event string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// 定时器回调和 Fire 并发时，回调可能在状态已经改变或者回滚之后才执行
+	if w.fsm != m || !m.pending(epoch) {
+		return
+	}
+	if err := w.fire(event, SystemActor, "timeout", nil); err != nil {
+		w.option.onError(err)
+	}
+}
+
+// fire 调用方需要持有锁
+func (w *Workflow) fire(event, actor, comment string, args []interface{}) error {
+	latest, err := w.store.Load(w.instance.ID)
+	if err != nil {
+		return err
+	}
+	if latest.Version != w.instance.Version {
+		return fmt.Errorf("%w: %s expect version %d, got %d", ErrConflict, w.instance.ID, latest.Version, w.instance.Version)
+	}
+
+	from := w.fsm.Current()
+	if err := w.fsm.Fire(event, args...); err != nil {
+		return err
+	}
+
+	next := w.instance.clone()
+	next.State = w.fsm.Current()
+	next.History = append(next.History, Record{
+		Event:   event,
+		From:    from,
+		To:      next.State,
+		Actor:   actor,
+		Comment: comment,
+		Time:    w.option.clock.Now(),
+	})
+	if err := w.store.Save(next); err != nil {
+		// 回滚时保留原来的时钟、错误回调等参数，定时转移从上一次转移的时间开始计算
+		w.fsm.Stop()
+		fsm, restoreErr := w.restore(w.fsm.def, from)
+		if restoreErr != nil {
+			return errors.Join(err, restoreErr)
+		}
+		w.fsm = fsm
+		return err
+	}
+	w.instance = next
+	return nil
+}
+
+func TestWorkflow_Fire(t *testing.T) {
+	def, err := NewDefinition("leader", []Transition{
+		{From: "leader", Event: "approve", To: "finance"},
+		{From: "finance", Event: "approve", To: "end"},
+		{From: "finance", Event: "reject", To: "leader"},
+	}, WithTerminal("end"))
+	require.NoError(t, err)
+
+	fileStore, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   fileStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			w, err := StartWorkflow(def, store, "R-1")
+			require.NoError(t, err)
+			_, err = StartWorkflow(def, store, "R-1")
+			assert.True(t, errors.Is(err, ErrConflict))
+
+			require.NoError(t, w.Fire("approve", "leader-zhang", "同意"))
+
+			// 两个人同时打开同一张审批单
+			w1, err := ResumeWorkflow(def, store, "R-1")
+			require.NoError(t, err)
+			w2, err := ResumeWorkflow(def, store, "R-1")
+			require.NoError(t, err)
+			assert.Equal(t, "finance", w1.Current())
+
+			require.NoError(t, w1.Fire("reject", "finance-li", "发票不全"))
+			assert.True(t, errors.Is(w2.Fire("approve", "finance-wang", ""), ErrConflict))
+			assert.Equal(t, "finance", w2.Current())
+
+			// 非法事件不会写入审计记录
+			assert.True(t, errors.Is(w1.Fire("reject", "leader-zhang", ""), ErrInvalidEvent))
+
+			w3, err := ResumeWorkflow(def, store, "R-1")
+			require.NoError(t, err)
+			assert.Equal(t, "leader", w3.Current())
+			assert.Equal(t, int64(3), w3.Version())
+
+			history := w3.History()
+			require.Len(t, history, 2)
+			assert.False(t, history[1].Time.IsZero())
+			history[0].Time, history[1].Time = time.Time{}, time.Time{}
+			assert.Equal(t, []Record{
+				{Event: "approve", From: "leader", To: "finance", Actor: "leader-zhang", Comment: "同意"},
+				{Event: "reject", From: "finance", To: "leader", Actor: "finance-li", Comment: "发票不全"},
+			}, history)
+
+			_, err = ResumeWorkflow(def, store, "R-2")
+			assert.True(t, errors.Is(err, ErrNotFound))
+		})
+	}
+}
+
+func TestWorkflow_Timeout(t *testing.T) {
+	def, err := NewDefinition("leader", []Transition{
+		{From: "leader", Event: "approve", To: "finance"},
+		{From: "leader", Event: "escalate", To: "director"},
+		{From: "director", Event: "approve", To: "finance"},
+		{From: "finance", Event: "approve", To: "end"},
+	}, WithTerminal("end"), WithTimeout("leader", 48*time.Hour, "escalate"))
+	require.NoError(t, err)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	store := NewMemoryStore()
+	w, err := StartWorkflow(def, store, "R-1", WithClock(clock))
+	require.NoError(t, err)
+
+	// 进程每 24 小时重启一次，恢复后只计算剩余的时间，48 小时后仍然会升级
+	clock.Advance(24 * time.Hour)
+	w.Stop()
+	w, err = ResumeWorkflow(def, store, "R-1", WithClock(clock))
+	require.NoError(t, err)
+	clock.Advance(23 * time.Hour)
+	assert.Equal(t, "leader", w.Current())
+	clock.Advance(time.Hour)
+	assert.Equal(t, "director", w.Current())
+
+	saved, err := store.Load("R-1")
+	require.NoError(t, err)
+	assert.Equal(t, "director", saved.State)
+	assert.Equal(t, []Record{
+		{Event: "escalate", From: "leader", To: "director", Actor: SystemActor, Comment: "timeout", Time: start.Add(48 * time.Hour)},
+	}, saved.History)
+
+	// Stop 之后不再触发
+	w, err = StartWorkflow(def, store, "R-2", WithClock(clock))
+	require.NoError(t, err)
+	w.Stop()
+	clock.Advance(100 * time.Hour)
+	saved, err = store.Load("R-2")
+	require.NoError(t, err)
+	assert.Equal(t, "leader", saved.State)
+}
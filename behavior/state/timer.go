@@ -0,0 +1,281 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 定时转移
+// 例如：领导 48 小时内没有审批，自动升级给总监
+// 进入状态时按照声明启动定时器，离开状态时取消，到期后自动触发声明的事件
+// 时钟可以注入，测试时使用 FakeClock 手动推进时间
+
+// Timer 定时器
+type Timer interface {
+	// Stop 取消定时器，已经触发或已经取消时返回 false
+	Stop() bool
+}
+
+// Clock 时钟
+type Clock interface {
+	Now() time.Time
+	// AfterFunc 经过 d 之后在独立的 goroutine 中执行 f
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// RealClock 系统时钟
+func RealClock() Clock {
+	return realClock{}
+}
+
+// FakeClock 手动推进的时钟，定时器在 Advance 中同步执行
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    int
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	seq      int
+	f        func()
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.seq++
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance 推进时间，按照到期时间的先后依次执行到期的定时器
+// 定时器回调中新建的定时器如果在推进范围内到期，也会被执行
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	target := c.now.Add(d)
+	for {
+		sort.Slice(c.timers, func(i, j int) bool {
+			if !c.timers[i].deadline.Equal(c.timers[j].deadline) {
+				return c.timers[i].deadline.Before(c.timers[j].deadline)
+			}
+			return c.timers[i].seq < c.timers[j].seq
+		})
+		if len(c.timers) == 0 || c.timers[0].deadline.After(target) {
+			break
+		}
+
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.deadline
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	c.now = target
+	c.lock.Unlock()
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type timeout struct {
+	after time.Duration
+	event string
+}
+
+// WithTimeout 进入 state 之后经过 after 还没有离开，自动触发 event
+func WithTimeout(state string, after time.Duration, event string) DefinitionOptFun {
+	return func(option *DefinitionOption) {
+		if option.timeouts == nil {
+			option.timeouts = map[string][]timeout{}
+		}
+		option.timeouts[state] = append(option.timeouts[state], timeout{after: after, event: event})
+	}
+}
+
+// FSMOption FSM 的可选参数
+type FSMOption struct {
+	clock     Clock
+	onError   func(err error)
+	enteredAt time.Time
+	// dispatch 不为空时，定时器到期后交给 dispatch 触发事件，例如 Workflow 需要保存和审计
+	dispatch func(m *FSM, epoch uint64, event string)
+}
+
+type FSMOptFun func(option *FSMOption)
+
+// WithClock 注入时钟，默认使用系统时钟
+func WithClock(clock Clock) FSMOptFun {
+	return func(option *FSMOption) {
+		option.clock = clock
+	}
+}
+
+// WithTimeoutErrorHandler 定时触发的事件失败时回调，例如守卫条件没有通过
+func WithTimeoutErrorHandler(handler func(err error)) FSMOptFun {
+	return func(option *FSMOption) {
+		option.onError = handler
+	}
+}
+
+// WithEnteredAt 恢复实例时指定进入当前状态的时间，定时转移只计算剩余的时间
+// 不指定时从恢复时开始重新计时，对 NewFSM 无效
+func WithEnteredAt(t time.Time) FSMOptFun {
+	return func(option *FSMOption) {
+		option.enteredAt = t
+	}
+}
+
+// schedule 为当前状态启动定时器，elapsed 是已经在当前状态停留的时间，调用方需要持有锁
+func (m *FSM) schedule(elapsed time.Duration) {
+	epoch := m.epoch
+	for _, t := range m.def.option.timeouts[m.current] {
+		event := t.event
+		remaining := t.after - elapsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		m.timers = append(m.timers, m.option.clock.AfterFunc(remaining, func() {
+			m.fireTimeout(epoch, event)
+		}))
+	}
+}
+
+// cancelTimers 调用方需要持有锁
+func (m *FSM) cancelTimers() {
+	for _, t := range m.timers {
+		t.Stop()
+	}
+	m.timers = nil
+	m.epoch++
+}
+
+func (m *FSM) fireTimeout(epoch uint64, event string) {
+	if m.option.dispatch != nil {
+		m.option.dispatch(m, epoch, event)
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// 定时器回调和离开状态并发时，回调可能在取消之后才执行
+	if epoch != m.epoch {
+		return
+	}
+	if err := m.fire(event, nil); err != nil {
+		m.option.onError(err)
+	}
+}
+
+// pending epoch 对应的定时器是否还有效
+func (m *FSM) pending(epoch uint64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return epoch == m.epoch
+}
+
+func TestFSM_Timeout(t *testing.T) {
+	def, err := NewDefinition("leader", []Transition{
+		{From: "leader", Event: "approve", To: "finance"},
+		{From: "leader", Event: "escalate", To: "director"},
+		{From: "leader", Event: "remind", To: "leader"},
+		{From: "director", Event: "approve", To: "finance"},
+		{From: "director", Event: "expire", To: "rejected", Guard: func(ctx *EventContext) bool { return false }},
+		{From: "finance", Event: "approve", To: "end"},
+	},
+		WithTerminal("end", "rejected"),
+		WithTimeout("leader", 48*time.Hour, "escalate"),
+		WithTimeout("leader", 24*time.Hour, "remind"),
+		WithTimeout("director", time.Hour, "expire"),
+	)
+	require.NoError(t, err)
+	require.NoError(t, def.Validate())
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	var errs []error
+	m := NewFSM(def, WithClock(clock), WithTimeoutErrorHandler(func(err error) { errs = append(errs, err) }))
+
+	// 24 小时提醒一次，自转移会重新计时，所以 48 小时的升级永远不会触发
+	clock.Advance(47 * time.Hour)
+	assert.Equal(t, "leader", m.Current())
+
+	// 在超时之前审批，定时器被取消
+	require.NoError(t, m.Fire("approve"))
+	clock.Advance(100 * time.Hour)
+	assert.Equal(t, "finance", m.Current())
+
+	// 只有一个升级的定时器
+	def, err = NewDefinition("leader", []Transition{
+		{From: "leader", Event: "escalate", To: "director"},
+		{From: "director", Event: "expire", To: "rejected", Guard: func(ctx *EventContext) bool { return false }},
+	}, WithTimeout("leader", 48*time.Hour, "escalate"), WithTimeout("director", time.Hour, "expire"))
+	require.NoError(t, err)
+	m = NewFSM(def, WithClock(clock), WithTimeoutErrorHandler(func(err error) { errs = append(errs, err) }))
+	clock.Advance(47 * time.Hour)
+	assert.Equal(t, "leader", m.Current())
+	clock.Advance(2 * time.Hour)
+	assert.Equal(t, "director", m.Current())
+	require.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], ErrGuardRejected))
+
+	// 恢复的实例重新计时，Stop 之后不再触发
+	m, err = RestoreFSM(def, "leader", WithClock(clock))
+	require.NoError(t, err)
+	m.Stop()
+	clock.Advance(100 * time.Hour)
+	assert.Equal(t, "leader", m.Current())
+
+	// 指定进入时间之后只计算剩余的时间
+	m, err = RestoreFSM(def, "leader", WithClock(clock), WithEnteredAt(clock.Now().Add(-47*time.Hour)))
+	require.NoError(t, err)
+	clock.Advance(time.Hour)
+	assert.Equal(t, "director", m.Current())
+	m.Stop()
+
+	def, err = NewDefinition("a", []Transition{{From: "a", Event: "go", To: "b"}}, WithTerminal("b"), WithTimeout("a", time.Second, "missing"))
+	require.NoError(t, err)
+	assert.EqualError(t, def.Validate(), "state a can not handle timeout event missing")
+}
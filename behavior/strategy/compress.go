@@ -0,0 +1,133 @@
+package strategy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 压缩保存，使用 gzip 压缩后保存到底层存储，Stat 返回的是压缩后的大小
+type compressStorage struct {
+	StorageStrategy
+}
+
+// NewCompressStorage 压缩后保存到 backend
+func NewCompressStorage(backend StorageStrategy) StorageStrategy {
+	return &compressStorage{StorageStrategy: backend}
+}
+
+func (s *compressStorage) Save(name string, data []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return s.StorageStrategy.Save(name, buf.Bytes())
+}
+
+func (s *compressStorage) Load(name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *compressStorage) Open(name string) (io.ReadCloser, error) {
+	r, err := s.StorageStrategy.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &gzipReader{Reader: zr, closer: r}, nil
+}
+
+func (s *compressStorage) Create(name string) (io.WriteCloser, error) {
+	w, err := s.StorageStrategy.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{Writer: gzip.NewWriter(w), closer: w}, nil
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	closer io.Closer
+}
+
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return r.closer.Close()
+}
+
+type gzipWriter struct {
+	*gzip.Writer
+	closer io.WriteCloser
+}
+
+// Close 先写完 gzip 的尾部，再关闭底层的 writer
+// gzip 尾部写入失败时放弃底层的 writer，不能提交缺少尾部、无法读取的文件
+func (w *gzipWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		abortWriter(w.closer)
+		return err
+	}
+	return w.closer.Close()
+}
+
+func (w *gzipWriter) abort() {
+	abortWriter(w.closer)
+}
+
+func TestCompressStorage_Abort(t *testing.T) {
+	backend := &failingStorage{StorageStrategy: NewMemoryStorage()}
+	storage := NewCompressStorage(backend)
+
+	w, err := storage.Create("a.txt")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("data"))
+	assert.Error(t, err)
+	assert.Error(t, w.Close())
+	assert.True(t, backend.aborted)
+	assert.False(t, backend.closed)
+}
+
+// failingStorage Create 返回的 writer 写入总是失败
+type failingStorage struct {
+	StorageStrategy
+	aborted, closed bool
+}
+
+func (s *failingStorage) Create(name string) (io.WriteCloser, error) {
+	return &failingWriter{storage: s}, nil
+}
+
+type failingWriter struct {
+	storage *failingStorage
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (w *failingWriter) Close() error {
+	w.storage.closed = true
+	return nil
+}
+
+func (w *failingWriter) abort() {
+	w.storage.aborted = true
+}
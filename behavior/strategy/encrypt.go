@@ -0,0 +1,342 @@
+package strategy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 加密存储使用 AES-GCM 认证加密，文件格式：
+// | magic "GOFE" 4 字节 | 版本 1 字节 | 密钥 ID 4 字节 | nonce 12 字节 | 密文 + tag |
+// 文件头作为附加数据参与认证，文件头或密文被篡改都会解密失败
+// 密钥通过 KeyProvider 管理，加密使用当前密钥，解密根据文件头中的密钥 ID 查找，轮换密钥后旧文件仍然可以读取
+
+const (
+	encryptMagic   = "GOFE"
+	encryptVersion = 1
+	headerSize     = len(encryptMagic) + 1 + 4 + 12
+)
+
+var (
+	// ErrKeyNotFound 找不到对应的密钥
+	ErrKeyNotFound = errors.New("encryption key not found")
+	// ErrTampered 文件被篡改或者密钥错误
+	ErrTampered = errors.New("encrypted data is tampered or key is wrong")
+)
+
+// KeyProvider 密钥管理
+type KeyProvider interface {
+	// CurrentKey 当前用于加密的密钥
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key 根据 ID 获取密钥，用于解密
+	Key(id uint32) ([]byte, error)
+}
+
+// MemoryKeyProvider 内存中的密钥，支持轮换
+type MemoryKeyProvider struct {
+	lock    sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewMemoryKeyProvider() *MemoryKeyProvider {
+	return &MemoryKeyProvider{keys: map[uint32][]byte{}}
+}
+
+// Rotate 添加新的密钥并设置为当前密钥，旧密钥保留用于解密，key 长度必须是 16、24 或 32 字节
+func (p *MemoryKeyProvider) Rotate(id uint32, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.keys[id]; ok {
+		return fmt.Errorf("key %d already exists", id)
+	}
+	p.keys[id] = append([]byte(nil), key...)
+	p.current = id
+	return nil
+}
+
+func (p *MemoryKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	key, ok := p.keys[p.current]
+	if !ok {
+		return 0, nil, ErrKeyNotFound
+	}
+	return p.current, key, nil
+}
+
+func (p *MemoryKeyProvider) Key(id uint32) ([]byte, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// envKeyProvider 从环境变量读取密钥，格式为 "id:hex,id:hex"，最后一个是当前密钥
+// 每次调用都会重新读取，修改环境变量即可完成轮换
+type envKeyProvider struct {
+	name string
+}
+
+// NewEnvKeyProvider 从环境变量读取密钥
+func NewEnvKeyProvider(name string) KeyProvider {
+	return envKeyProvider{name: name}
+}
+
+func (p envKeyProvider) load() (*MemoryKeyProvider, error) {
+	value := os.Getenv(p.name)
+	if value == "" {
+		return nil, fmt.Errorf("%w: env %s is empty", ErrKeyNotFound, p.name)
+	}
+
+	keys := NewMemoryKeyProvider()
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("env %s is invalid", p.name)
+		}
+		id, err := strconv.ParseUint(kv[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("env %s is invalid: %w", p.name, err)
+		}
+		key, err := hex.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("env %s is invalid: %w", p.name, err)
+		}
+		if err := keys.Rotate(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("env %s is invalid: %w", p.name, err)
+		}
+	}
+	return keys, nil
+}
+
+func (p envKeyProvider) CurrentKey() (uint32, []byte, error) {
+	keys, err := p.load()
+	if err != nil {
+		return 0, nil, err
+	}
+	return keys.CurrentKey()
+}
+
+func (p envKeyProvider) Key(id uint32) ([]byte, error) {
+	keys, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	return keys.Key(id)
+}
+
+// 加密保存，加密后保存到底层存储
+// AES-GCM 需要完整的数据才能认证，Open/Create 会在内存中缓冲整个文件
+type encryptStorage struct {
+	StorageStrategy
+	keys KeyProvider
+}
+
+// NewEncryptStorage 加密后保存到 backend，使用 keys 管理密钥
+func NewEncryptStorage(backend StorageStrategy, keys KeyProvider) StorageStrategy {
+	return &encryptStorage{StorageStrategy: backend, keys: keys}
+}
+
+// NewEncryptFileStorage 加密后保存到 root 目录下，默认只有所有者可以读写
+func NewEncryptFileStorage(root string, keys KeyProvider, opts ...FileStorageOptFun) StorageStrategy {
+	return NewEncryptStorage(newFileStorage(root, append([]FileStorageOptFun{WithFileMode(0600)}, opts...)...), keys)
+}
+
+func (s *encryptStorage) Save(name string, data []byte) error {
+	data, err := encrypt(s.keys, data)
+	if err != nil {
+		return err
+	}
+	return s.StorageStrategy.Save(name, data)
+}
+
+func (s *encryptStorage) Load(name string) ([]byte, error) {
+	data, err := s.StorageStrategy.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(s.keys, data)
+}
+
+// Versions 底层存储支持历史版本时可用
+func (s *encryptStorage) Versions(name string) (int, error) {
+	versioned, ok := s.StorageStrategy.(Versioned)
+	if !ok {
+		return 0, errors.New("storage does not keep versions")
+	}
+	return versioned.Versions(name)
+}
+
+// LoadVersion 读取历史版本并解密
+func (s *encryptStorage) LoadVersion(name string, version int) ([]byte, error) {
+	versioned, ok := s.StorageStrategy.(Versioned)
+	if !ok {
+		return nil, errors.New("storage does not keep versions")
+	}
+	data, err := versioned.LoadVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(s.keys, data)
+}
+
+func (s *encryptStorage) Open(name string) (io.ReadCloser, error) {
+	data, err := s.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *encryptStorage) Create(name string) (io.WriteCloser, error) {
+	return &writeBuffer{save: func(data []byte) error {
+		return s.Save(name, data)
+	}}, nil
+}
+
+func encrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrKeyNotFound
+	}
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, encryptMagic)
+	header[len(encryptMagic)] = encryptVersion
+	binary.BigEndian.PutUint32(header[len(encryptMagic)+1:], id)
+	nonce := header[len(encryptMagic)+5:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, nonce, data, header), nil
+}
+
+func decrypt(keys KeyProvider, data []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrKeyNotFound
+	}
+	if len(data) < headerSize || !bytes.HasPrefix(data, []byte(encryptMagic)) {
+		return nil, errors.New("not an encrypted file")
+	}
+	if v := data[len(encryptMagic)]; v != encryptVersion {
+		return nil, fmt.Errorf("unsupported encrypted file version: %d", v)
+	}
+
+	id := binary.BigEndian.Uint32(data[len(encryptMagic)+1:])
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := data[:headerSize]
+	nonce := header[len(encryptMagic)+5:]
+	plain, err := aead.Open(nil, nonce, data[headerSize:], header)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return plain, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func TestEncryptFileStorage(t *testing.T) {
+	keys := NewMemoryKeyProvider()
+	require.NoError(t, keys.Rotate(1, bytes.Repeat([]byte{1}, 32)))
+	dir := t.TempDir()
+	storage := NewEncryptFileStorage(dir, keys)
+
+	old := "old.txt"
+	require.NoError(t, storage.Save(old, []byte("sensitive data")))
+
+	raw, err := os.ReadFile(filepath.Join(dir, old))
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "sensitive data")
+	info, err := os.Stat(filepath.Join(dir, old))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	data, err := storage.Load(old)
+	require.NoError(t, err)
+	assert.Equal(t, "sensitive data", string(data))
+
+	// 轮换密钥后，新文件使用新密钥，旧文件仍然可以读取
+	require.NoError(t, keys.Rotate(2, bytes.Repeat([]byte{2}, 32)))
+	name := "new.txt"
+	require.NoError(t, storage.Save(name, []byte("new data")))
+	raw, err = os.ReadFile(filepath.Join(dir, name))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(raw[5:]))
+	data, err = storage.Load(old)
+	require.NoError(t, err)
+	assert.Equal(t, "sensitive data", string(data))
+
+	// 篡改密文、篡改文件头中的密钥 ID
+	for _, i := range []int{len(raw) - 1, headerSize, 8} {
+		tampered := append([]byte(nil), raw...)
+		tampered[i] ^= 1
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), tampered, 0600))
+		_, err = storage.Load(name)
+		assert.Error(t, err)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), raw[:len(raw)-1], 0600))
+	_, err = storage.Load(name)
+	assert.True(t, errors.Is(err, ErrTampered))
+
+	// 明文文件不能当作加密文件读取
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("plain text file content"), 0600))
+	_, err = storage.Load(name)
+	assert.Error(t, err)
+
+	// 环境变量中的密钥
+	t.Setenv("TEST_STORAGE_KEYS", "1:"+hex.EncodeToString(bytes.Repeat([]byte{1}, 32))+",2:"+hex.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	envStorage := NewEncryptFileStorage(dir, NewEnvKeyProvider("TEST_STORAGE_KEYS"))
+	data, err = envStorage.Load(old)
+	require.NoError(t, err)
+	assert.Equal(t, "sensitive data", string(data))
+
+	t.Setenv("TEST_STORAGE_KEYS", "")
+	assert.True(t, errors.Is(envStorage.Save(name, data), ErrKeyNotFound))
+}
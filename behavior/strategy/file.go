@@ -0,0 +1,441 @@
+package strategy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 保存到文件
+// 文件名使用 / 分隔，相对于 root 目录，root 为空时相对于当前工作目录
+// 文件名必须是 root 目录内的相对路径，绝对路径以及通过 ".." 跳出 root 目录的文件名会被拒绝
+// 写入是原子的：先写临时文件并 fsync，再重命名覆盖目标文件，最后 fsync 目录，写到一半崩溃不会留下不完整的文件
+// 临时文件和历史版本与目标文件放在同一目录，使用 "~" 作为标记，所以文件名中不能包含 "~"
+
+// ErrChecksumMismatch 写入后读回的内容与写入的内容不一致
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Versioned 支持保留历史版本的存储
+type Versioned interface {
+	// Versions 历史版本数量，版本 1 是最近一次被覆盖的内容
+	Versions(name string) (int, error)
+	LoadVersion(name string, version int) ([]byte, error)
+}
+
+// FileStorageOption 文件存储的可选参数
+type FileStorageOption struct {
+	perm   os.FileMode
+	verify bool
+	keep   int
+}
+
+type FileStorageOptFun func(option *FileStorageOption)
+
+// WithFileMode 文件权限，默认 0644
+func WithFileMode(perm os.FileMode) FileStorageOptFun {
+	return func(option *FileStorageOption) {
+		option.perm = perm
+	}
+}
+
+// WithVerify 重命名之前读回临时文件，校验 SHA-256 与写入的内容一致
+func WithVerify() FileStorageOptFun {
+	return func(option *FileStorageOption) {
+		option.verify = true
+	}
+}
+
+// WithKeepVersions 覆盖文件时保留最近 n 个历史版本
+func WithKeepVersions(n int) FileStorageOptFun {
+	return func(option *FileStorageOption) {
+		option.keep = n
+	}
+}
+
+type fileStorage struct {
+	root   string
+	option FileStorageOption
+}
+
+// NewFileStorage 保存到 root 目录下
+func NewFileStorage(root string, opts ...FileStorageOptFun) StorageStrategy {
+	return newFileStorage(root, opts...)
+}
+
+func newFileStorage(root string, opts ...FileStorageOptFun) *fileStorage {
+	option := FileStorageOption{perm: 0644}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	return &fileStorage{root: root, option: option}
+}
+
+func (s fileStorage) path(name string) (string, error) {
+	if strings.Contains(name, "~") {
+		return "", fmt.Errorf("invalid file name %q: ~ is reserved", name)
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("invalid file name %q: must be a relative path inside root", name)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name)), nil
+}
+
+func (s fileStorage) Save(name string, data []byte) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.(*atomicWriter).abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (s fileStorage) Load(name string) ([]byte, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// Delete 同时删除历史版本
+func (s fileStorage) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	for i := 1; ; i++ {
+		if err := os.Remove(versionPath(p, i)); err != nil {
+			break
+		}
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s fileStorage) List(prefix string) ([]string, error) {
+	// 只需要遍历 prefix 所在的目录
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if !filepath.IsLocal(filepath.FromSlash(prefix[:i])) {
+			return nil, fmt.Errorf("invalid prefix %q: must be a relative path inside root", prefix)
+		}
+		dir = filepath.Join(s.root, filepath.FromSlash(prefix[:i]))
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.Contains(d.Name(), "~") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.rootDir(), p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (s fileStorage) Stat(name string) (FileInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s fileStorage) Open(name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Create 写入临时文件，Close 时提交
+func (s fileStorage) Create(name string) (io.WriteCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+"~tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Chmod(s.option.perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &atomicWriter{storage: s, path: p, tmp: tmp, hash: sha256.New()}, nil
+}
+
+func (s fileStorage) Versions(name string) (int, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ; n < s.option.keep; n++ {
+		if _, err := os.Stat(versionPath(p, n+1)); err != nil {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (s fileStorage) LoadVersion(name string, version int) ([]byte, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if version < 1 || version > s.option.keep {
+		return nil, fmt.Errorf("%s version %d: %w", name, version, ErrNotExist)
+	}
+	return os.ReadFile(versionPath(p, version))
+}
+
+func (s fileStorage) rootDir() string {
+	if s.root == "" {
+		return "."
+	}
+	return s.root
+}
+
+// rotate 将当前文件保存为版本 1，已有的版本依次后移，超过 keep 的删除
+// 当前文件使用硬链接保留，目标文件在整个过程中始终存在
+func (s fileStorage) rotate(p string) error {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return nil
+	}
+
+	os.Remove(versionPath(p, s.option.keep))
+	for i := s.option.keep - 1; i >= 1; i-- {
+		if err := os.Rename(versionPath(p, i), versionPath(p, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Link(p, versionPath(p, 1)); err != nil {
+		// 不支持硬链接的文件系统，复制一份
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(versionPath(p, 1), data, s.option.perm)
+	}
+	return nil
+}
+
+func versionPath(p string, version int) string {
+	return p + "~v" + strconv.Itoa(version)
+}
+
+// atomicWriter 写入临时文件，Close 时 fsync、校验、保留历史版本，再重命名为目标文件
+// 任意一次写入失败后，临时文件的内容已经不完整，Close 会放弃写入并返回第一次写入的错误
+type atomicWriter struct {
+	storage fileStorage
+	path    string
+	tmp     *os.File
+	hash    hash.Hash
+	err     error
+}
+
+func (w *atomicWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	w.err = err
+	return n, err
+}
+
+func (w *atomicWriter) Close() error {
+	if w.err != nil {
+		w.abort()
+		return w.err
+	}
+	if err := w.commit(); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+func (w *atomicWriter) commit() error {
+	if err := w.tmp.Sync(); err != nil {
+		return err
+	}
+	if err := w.tmp.Close(); err != nil {
+		return err
+	}
+
+	if w.storage.option.verify {
+		data, err := os.ReadFile(w.tmp.Name())
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], w.hash.Sum(nil)) {
+			return fmt.Errorf("%s: %w", w.path, ErrChecksumMismatch)
+		}
+	}
+
+	if w.storage.option.keep > 0 {
+		if err := w.storage.rotate(w.path); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(w.tmp.Name(), w.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(w.path))
+	return nil
+}
+
+func (w *atomicWriter) abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// syncDir 持久化目录项，部分系统（例如 Windows）不支持，忽略错误
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func TestFileStorage_Atomic(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewFileStorage(dir, WithVerify(), WithKeepVersions(2))
+	require.NoError(t, storage.Save("a.txt", []byte("v1")))
+
+	// 写到一半崩溃（没有 Close），原文件保持不变
+	w, err := storage.Create("a.txt")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("half"))
+	require.NoError(t, err)
+	data, err := storage.Load("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	names, err := storage.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt"}, names)
+	w.(*atomicWriter).abort()
+
+	// 写到一半失败，Close 放弃写入，原文件保持不变
+	w, err = storage.Create("a.txt")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("part"))
+	require.NoError(t, err)
+	w.(*atomicWriter).tmp.Close()
+	_, err = w.Write([]byte("rest"))
+	require.Error(t, err)
+	assert.True(t, errors.Is(w.Close(), os.ErrClosed))
+	data, err = storage.Load("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// 保留最近两个版本
+	for _, v := range []string{"v2", "v3", "v4"} {
+		require.NoError(t, storage.Save("a.txt", []byte(v)))
+	}
+	versioned := storage.(Versioned)
+	n, err := versioned.Versions("a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for version, want := range map[int]string{1: "v3", 2: "v2"} {
+		data, err := versioned.LoadVersion("a.txt", version)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+	_, err = versioned.LoadVersion("a.txt", 3)
+	assert.True(t, errors.Is(err, ErrNotExist))
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	require.NoError(t, storage.Delete("a.txt"))
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	assert.Error(t, storage.Save("a~b.txt", []byte("reserved")))
+
+	// 不能跳出 root 目录
+	for _, name := range []string{"../escape.txt", "sub/../../escape.txt", filepath.Join(dir, "abs.txt")} {
+		assert.Error(t, storage.Save(name, []byte("escape")), name)
+		_, err := storage.Load(name)
+		assert.Error(t, err, name)
+		assert.Error(t, storage.Delete(name), name)
+	}
+	_, err = storage.List("../")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "escape.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// 加密存储同样是原子写入，历史版本读取时解密
+	keys := NewMemoryKeyProvider()
+	require.NoError(t, keys.Rotate(1, bytes.Repeat([]byte{1}, 32)))
+	encrypted := NewEncryptFileStorage(dir, keys, WithKeepVersions(1))
+	name := "secret.txt"
+	require.NoError(t, encrypted.Save(name, []byte("old secret")))
+	require.NoError(t, encrypted.Save(name, []byte("new secret")))
+	data, err = encrypted.(Versioned).LoadVersion(name, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "old secret", string(data))
+	info, err := os.Stat(filepath.Join(dir, name))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
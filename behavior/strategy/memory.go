@@ -0,0 +1,90 @@
+package strategy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 保存到内存，一般用于测试
+type memoryStorage struct {
+	lock  sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryStorage() StorageStrategy {
+	return &memoryStorage{files: map[string]memoryFile{}}
+}
+
+func (s *memoryStorage) Save(name string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[name] = memoryFile{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (s *memoryStorage) Load(name string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (s *memoryStorage) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memoryStorage) List(prefix string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var names []string
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryStorage) Stat(name string) (FileInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	f, ok := s.files[name]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("%s: %w", name, ErrNotExist)
+	}
+	return FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (s *memoryStorage) Open(name string) (io.ReadCloser, error) {
+	data, err := s.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStorage) Create(name string) (io.WriteCloser, error) {
+	return &writeBuffer{save: func(data []byte) error {
+		return s.Save(name, data)
+	}}, nil
+}
@@ -0,0 +1,208 @@
+package strategy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 策略注册表
+// 策略的定义、创建、使用解耦之后，策略可以由插件在 init 中按名字注册，使用方通过名字或者选择规则获取
+// 选择规则按照声明顺序匹配，第一条匹配的规则生效，都不匹配时使用默认策略，例如：
+//   {"rules": [{"classification": "sensitive", "strategy": "encrypt_file"}], "default": "file"}
+
+// Attributes 选择策略时的调用参数
+type Attributes struct {
+	// Classification 数据分级，例如 public、internal、sensitive
+	Classification string
+	Size           int64
+	Tenant         string
+}
+
+// Rule 选择规则，为空的条件表示不限制
+type Rule struct {
+	Classification string   `json:"classification,omitempty"`
+	Tenants        []string `json:"tenants,omitempty"`
+	// MinSize、MaxSize 数据大小范围 [MinSize, MaxSize)，MaxSize 为 0 表示不限制
+	MinSize  int64  `json:"min_size,omitempty"`
+	MaxSize  int64  `json:"max_size,omitempty"`
+	Strategy string `json:"strategy"`
+}
+
+// Match 规则是否匹配
+func (r Rule) Match(attrs Attributes) bool {
+	if r.Classification != "" && r.Classification != attrs.Classification {
+		return false
+	}
+	if len(r.Tenants) > 0 && !contains(r.Tenants, attrs.Tenant) {
+		return false
+	}
+	if attrs.Size < r.MinSize || (r.MaxSize > 0 && attrs.Size >= r.MaxSize) {
+		return false
+	}
+	return true
+}
+
+// SelectionConfig 选择规则配置
+type SelectionConfig struct {
+	Rules   []Rule `json:"rules"`
+	Default string `json:"default"`
+}
+
+// Registry 策略注册表，并发安全
+type Registry[T any] struct {
+	lock   sync.RWMutex
+	items  map[string]T
+	config SelectionConfig
+}
+
+func NewRegistry[T any]() *Registry[T] {
+	return &Registry[T]{items: map[string]T{}}
+}
+
+// Register 注册策略，名字重复时返回错误
+func (r *Registry[T]) Register(name string, item T) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.items[name]; ok {
+		return fmt.Errorf("strategy already registered: %s", name)
+	}
+	r.items[name] = item
+	return nil
+}
+
+// MustRegister 注册策略，名字重复时 panic，一般在 init 中使用
+func (r *Registry[T]) MustRegister(name string, item T) {
+	if err := r.Register(name, item); err != nil {
+		panic(err)
+	}
+}
+
+// Get 根据名字获取策略
+func (r *Registry[T]) Get(name string) (T, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	item, ok := r.items[name]
+	if !ok {
+		return item, fmt.Errorf("not found strategy: %s", name)
+	}
+	return item, nil
+}
+
+// Names 已注册的策略名字，按字典序排列
+func (r *Registry[T]) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.items))
+	for name := range r.items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Configure 设置选择规则，规则中引用的策略必须已经注册
+func (r *Registry[T]) Configure(config SelectionConfig) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, rule := range config.Rules {
+		if _, ok := r.items[rule.Strategy]; !ok {
+			return fmt.Errorf("rule %d: not found strategy: %s", i, rule.Strategy)
+		}
+	}
+	if _, ok := r.items[config.Default]; config.Default != "" && !ok {
+		return fmt.Errorf("default: not found strategy: %s", config.Default)
+	}
+	r.config = config
+	return nil
+}
+
+// ConfigureJSON 从 JSON 中读取选择规则
+func (r *Registry[T]) ConfigureJSON(data []byte) error {
+	var config SelectionConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	return r.Configure(config)
+}
+
+// Select 根据调用参数选择策略
+func (r *Registry[T]) Select(attrs Attributes) (T, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	name := r.config.Default
+	for _, rule := range r.config.Rules {
+		if rule.Match(attrs) {
+			name = rule.Strategy
+			break
+		}
+	}
+
+	item, ok := r.items[name]
+	if !ok {
+		return item, fmt.Errorf("no strategy matches %+v", attrs)
+	}
+	return item, nil
+}
+
+func contains(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegistry_Select(t *testing.T) {
+	r := NewRegistry[string]()
+	for _, name := range []string{"file", "encrypt_file", "compress_file", "s3"} {
+		r.MustRegister(name, name)
+	}
+	assert.Error(t, r.Register("file", "file"))
+	assert.Equal(t, []string{"compress_file", "encrypt_file", "file", "s3"}, r.Names())
+
+	// 没有配置规则和默认策略
+	_, err := r.Select(Attributes{})
+	assert.Error(t, err)
+
+	require.NoError(t, r.ConfigureJSON([]byte(`{
+		"rules": [
+			{"tenants": ["tenant-a"], "strategy": "s3"},
+			{"classification": "sensitive", "strategy": "encrypt_file"},
+			{"min_size": 1048576, "strategy": "compress_file"}
+		],
+		"default": "file"
+	}`)))
+
+	tests := []struct {
+		name  string
+		attrs Attributes
+		want  string
+	}{
+		{name: "tenant", attrs: Attributes{Tenant: "tenant-a", Classification: "sensitive"}, want: "s3"},
+		{name: "sensitive", attrs: Attributes{Tenant: "tenant-b", Classification: "sensitive", Size: 10 << 20}, want: "encrypt_file"},
+		{name: "large", attrs: Attributes{Size: 1 << 20}, want: "compress_file"},
+		{name: "default", attrs: Attributes{Size: 1<<20 - 1}, want: "file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Select(tt.attrs)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	assert.Error(t, r.Configure(SelectionConfig{Rules: []Rule{{Strategy: "unknown"}}}))
+	assert.Error(t, r.Configure(SelectionConfig{Default: "unknown"}))
+}
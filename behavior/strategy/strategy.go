@@ -8,74 +8,209 @@
 package strategy
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
-	"io/ioutil"
-	"os"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"strings"
 	"testing"
+	"time"
 )
 
 // 例子：我们在保存文件的时候，由于政策或者其他的原因可能需要选择不同的存储方式，敏感数据我们需要加密存储，不敏感的数据我们可以直接明文保存
 
 // 定义策略接口
+// Save/Load 一次性读写整个文件，Open/Create 用于流式读写大文件
+// 文件不存在时返回的错误满足 errors.Is(err, ErrNotExist)，删除不存在的文件不会返回错误
 type StorageStrategy interface {
 	Save(name string, data []byte) error
+	Load(name string) ([]byte, error)
+	Delete(name string) error
+	// List 返回以 prefix 开头的所有文件名，按字典序排列
+	List(prefix string) ([]string, error)
+	Stat(name string) (FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	// Create 写入的数据在 Close 成功之后才保证保存
+	Create(name string) (io.WriteCloser, error)
 }
 
-var strategys = map[string]StorageStrategy{
-	"file":&fileStorage{},
-	"encrypt_file":&encryptFileStorage{},
+// FileInfo 文件信息
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrNotExist 文件不存在
+var ErrNotExist = fs.ErrNotExist
+
+// strategys 存储策略注册表，其他包可以通过 RegisterStorageStrategy 注册自己的存储
+var strategys = NewRegistry[StorageStrategy]()
+
+func init() {
+	strategys.MustRegister("file", NewFileStorage(""))
+	// 密钥从环境变量 STORAGE_ENCRYPT_KEYS 中读取
+	strategys.MustRegister("encrypt_file", NewEncryptFileStorage("", NewEnvKeyProvider("STORAGE_ENCRYPT_KEYS")))
+	strategys.MustRegister("compress_file", NewCompressStorage(NewFileStorage("")))
+
+	// 默认规则：敏感数据加密保存，其他明文保存
+	if err := strategys.Configure(SelectionConfig{
+		Rules:   []Rule{{Classification: "sensitive", Strategy: "encrypt_file"}},
+		Default: "file",
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterStorageStrategy 注册存储策略，一般在 init 中调用
+func RegisterStorageStrategy(name string, s StorageStrategy) error {
+	return strategys.Register(name, s)
+}
+
+// ConfigureStorageStrategy 设置存储策略的选择规则
+func ConfigureStorageStrategy(config SelectionConfig) error {
+	return strategys.Configure(config)
 }
 
 func NewStorageStrategy(t string)(StorageStrategy,error){
-	s, ok := strategys[t]
-	if !ok{
+	s, err := strategys.Get(t)
+	if err != nil{
 		return nil, fmt.Errorf("not found StorageStrategy: %s", t)
 	}
 	return s, nil
 }
 
-// 保存到文件
-type fileStorage struct {
+// SelectStorageStrategy 根据选择规则获取存储策略
+func SelectStorageStrategy(attrs Attributes) (StorageStrategy, error) {
+	return strategys.Select(attrs)
 }
 
-func (s fileStorage) Save(name string, data []byte) error {
-	return ioutil.WriteFile(name, data, os.ModeAppend)
+// writeBuffer 先写入内存，Close 时一次性保存，用于不支持流式写入的存储
+type writeBuffer struct {
+	bytes.Buffer
+	save func(data []byte) error
 }
 
-// 加密保存
-type encryptFileStorage struct {
+func (w *writeBuffer) Close() error {
+	return w.save(w.Bytes())
 }
 
-func (s encryptFileStorage) Save(name string, data []byte)  error {
-	date,err:=encrypt(data)
-	if err != nil {
-		return err
-	}
+func (w *writeBuffer) abort() {
+	w.Reset()
+}
 
-	return ioutil.WriteFile(name,date, os.ModeAppend)
+// aborter 可以放弃写入的 writer，放弃后不会提交已经写入的内容
+type aborter interface {
+	abort()
 }
 
-func encrypt(data []byte)([]byte, error)  {
-	// 加密
-	return data, nil
+// abortWriter 放弃写入，不支持放弃的 writer 只能关闭
+func abortWriter(w io.WriteCloser) {
+	if a, ok := w.(aborter); ok {
+		a.abort()
+		return
+	}
+	w.Close()
 }
 
 func Test_demo(t *testing.T) {
 	// 假设这里获取数据，以及数据是否敏感
+	// 敏感数据使用哪种存储由选择规则决定，使用方不再需要判断
 	data, sensitive := getData()
-	strategyType := "file"
+	classification := "public"
 	if sensitive {
-		strategyType = "encrypt_file"
+		classification = "sensitive"
 	}
 
-	storage, err := NewStorageStrategy(strategyType)
+	storage, err := SelectStorageStrategy(Attributes{Classification: classification, Size: int64(len(data))})
 	assert.NoError(t, err)
 	assert.NoError(t, storage.Save("./test.txt", data))
+
+	storage, err = SelectStorageStrategy(Attributes{Classification: "sensitive"})
+	assert.NoError(t, err)
+	encrypted, err := NewStorageStrategy("encrypt_file")
+	assert.NoError(t, err)
+	assert.Equal(t, encrypted, storage)
 }
 
 // getData 获取数据的方法
 // 返回数据，以及数据是否敏感
 func getData() ([]byte, bool) {
 	return []byte("test data"), false
-}
\ No newline at end of file
+}
+
+func TestStorageStrategy(t *testing.T) {
+	keys := NewMemoryKeyProvider()
+	require.NoError(t, keys.Rotate(1, bytes.Repeat([]byte{1}, 32)))
+
+	storages := map[string]StorageStrategy{
+		"file":          NewFileStorage(t.TempDir()),
+		"memory":        NewMemoryStorage(),
+		"compress":      NewCompressStorage(NewMemoryStorage()),
+		"encrypt":       NewEncryptStorage(NewFileStorage(t.TempDir()), keys),
+		"compress_file": NewCompressStorage(NewFileStorage(t.TempDir())),
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, storage)
+		})
+	}
+}
+
+// testStorage 所有存储都需要满足的行为
+func testStorage(t *testing.T, storage StorageStrategy) {
+	_, err := storage.Load("docs/a.txt")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	_, err = storage.Stat("docs/a.txt")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	_, err = storage.Open("docs/a.txt")
+	assert.True(t, errors.Is(err, ErrNotExist))
+
+	require.NoError(t, storage.Save("docs/a.txt", []byte("hello")))
+	require.NoError(t, storage.Save("docs/b.txt", []byte("world")))
+	require.NoError(t, storage.Save("image/c.png", []byte("png")))
+	require.NoError(t, storage.Save("docs/a.txt", []byte("hello again")))
+
+	data, err := storage.Load("docs/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello again", string(data))
+
+	info, err := storage.Stat("docs/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/b.txt", info.Name)
+	assert.True(t, info.Size > 0)
+	assert.False(t, info.ModTime.IsZero())
+
+	// 流式读写
+	w, err := storage.Create("big/file.txt")
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := io.WriteString(w, "0123456789")
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	r, err := storage.Open("big/file.txt")
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, strings.Repeat("0123456789", 1000), string(data))
+
+	names, err := storage.List("docs/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/a.txt", "docs/b.txt"}, names)
+	names, err = storage.List("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"big/file.txt", "docs/a.txt", "docs/b.txt", "image/c.png"}, names)
+
+	require.NoError(t, storage.Delete("docs/a.txt"))
+	require.NoError(t, storage.Delete("docs/a.txt"))
+	_, err = storage.Load("docs/a.txt")
+	assert.True(t, errors.Is(err, ErrNotExist))
+	names, err = storage.List("docs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/b.txt"}, names)
+}
@@ -0,0 +1,110 @@
+package template
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 短信编码
+// 内容全部是 GSM-7 字符时使用 GSM-7 编码，单条 160 个字符，长短信每条 153 个字符（6 个字节用于拼接头）
+// 扩展字符 ^{}\[~]|€ 需要转义，占两个字符，并且不能被拆到两条中
+// 否则使用 UCS-2 编码，单条 70 个字符，长短信每条 67 个字符，超出 BMP 的字符（例如 emoji）占两个字符
+
+// Encoding 短信编码
+type Encoding int
+
+const (
+	GSM7 Encoding = iota
+	UCS2
+)
+
+func (e Encoding) String() string {
+	if e == GSM7 {
+		return "GSM-7"
+	}
+	return "UCS-2"
+}
+
+const (
+	gsm7Basic    = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extended = "\f^{}\\[~]|€"
+)
+
+// DetectEncoding 内容使用的编码
+func DetectEncoding(content string) Encoding {
+	for _, c := range content {
+		if !strings.ContainsRune(gsm7Basic, c) && !strings.ContainsRune(gsm7Extended, c) {
+			return UCS2
+		}
+	}
+	return GSM7
+}
+
+// Segments 内容使用的编码，以及需要拆分成几条短信，空内容算作一条
+func Segments(content string) (Encoding, int) {
+	encoding := DetectEncoding(content)
+	single, multi := 160, 153
+	if encoding == UCS2 {
+		single, multi = 70, 67
+	}
+
+	total := 0
+	for _, c := range content {
+		total += charSize(encoding, c)
+	}
+	if total <= single {
+		return encoding, 1
+	}
+
+	// 长短信逐个字符装入，装不下的字符放到下一条
+	segments, used := 1, 0
+	for _, c := range content {
+		size := charSize(encoding, c)
+		if used+size > multi {
+			segments++
+			used = 0
+		}
+		used += size
+	}
+	return encoding, segments
+}
+
+func charSize(encoding Encoding, c rune) int {
+	if encoding == UCS2 {
+		return len(utf16.Encode([]rune{c}))
+	}
+	if strings.ContainsRune(gsm7Extended, c) {
+		return 2
+	}
+	return 1
+}
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		encoding Encoding
+		segments int
+	}{
+		{name: "empty", content: "", encoding: GSM7, segments: 1},
+		{name: "gsm7 single", content: strings.Repeat("a", 160), encoding: GSM7, segments: 1},
+		{name: "gsm7 multi", content: strings.Repeat("a", 161), encoding: GSM7, segments: 2},
+		{name: "gsm7 extended", content: strings.Repeat("€", 80), encoding: GSM7, segments: 1},
+		{name: "gsm7 extended not split", content: strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), encoding: GSM7, segments: 3},
+		{name: "ucs2 single", content: strings.Repeat("验", 70), encoding: UCS2, segments: 1},
+		{name: "ucs2 multi", content: strings.Repeat("验", 71), encoding: UCS2, segments: 2},
+		{name: "ucs2 mixed", content: "Code 1234 验证码", encoding: UCS2, segments: 1},
+		{name: "surrogate", content: strings.Repeat("😀", 35), encoding: UCS2, segments: 1},
+		{name: "surrogate not split", content: strings.Repeat("a", 66) + strings.Repeat("😀", 34), encoding: UCS2, segments: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoding, segments := Segments(tt.content)
+			assert.Equal(t, tt.encoding, encoding)
+			assert.Equal(t, tt.segments, segments)
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 限流和去重
+// Limiter 按 key 限流，内存实现有滑动窗口和令牌桶两种，分布式部署时可以基于 redis 等实现同样的接口
+// IdempotencyStore 记录幂等键，同一个幂等键在有效期内只会发送一次
+
+var (
+	// ErrRateLimited 发送太频繁
+	ErrRateLimited = errors.New("rate limited")
+	// ErrDuplicate 幂等键已经发送过，本次发送被忽略，Send 同时返回第一次发送的消息 ID
+	ErrDuplicate = errors.New("duplicate send")
+)
+
+// Limiter 限流器
+type Limiter interface {
+	// Allow 是否允许 key 再发送一次，允许时计入一次
+	Allow(key string) (bool, error)
+}
+
+// IdempotencyStore 幂等键存储
+type IdempotencyStore interface {
+	// Reserve 占用幂等键并绑定消息 ID，ttl 内已经被占用时返回 false 以及占用时绑定的消息 ID
+	Reserve(key, id string, ttl time.Duration) (string, bool, error)
+	// Release 释放幂等键，发送失败时调用，允许重试
+	Release(key string) error
+}
+
+// LimiterOption 限流器的可选参数
+type LimiterOption struct {
+	now func() time.Time
+}
+
+type LimiterOptFun func(option *LimiterOption)
+
+// WithNow 替换时钟，用于测试
+func WithNow(now func() time.Time) LimiterOptFun {
+	return func(option *LimiterOption) {
+		option.now = now
+	}
+}
+
+func newLimiterOption(opts []LimiterOptFun) LimiterOption {
+	option := LimiterOption{now: time.Now}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	return option
+}
+
+// SlidingWindow 滑动窗口限流，任意 window 时间内最多 limit 次
+// 每个窗口清理一次所有记录都已经过期的 key，内存只和最近一个窗口内出现的 key 有关
+type SlidingWindow struct {
+	lock    sync.Mutex
+	limit   int
+	window  time.Duration
+	option  LimiterOption
+	events  map[string][]time.Time
+	sweepAt time.Time
+}
+
+func NewSlidingWindow(limit int, window time.Duration, opts ...LimiterOptFun) *SlidingWindow {
+	return &SlidingWindow{limit: limit, window: window, option: newLimiterOption(opts), events: map[string][]time.Time{}}
+}
+
+func (l *SlidingWindow) Allow(key string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.option.now()
+	l.sweep(now)
+	events := l.events[key]
+	// 丢弃窗口之外的记录
+	i := 0
+	for i < len(events) && !events[i].After(now.Add(-l.window)) {
+		i++
+	}
+	events = events[i:]
+
+	if len(events) >= l.limit {
+		l.events[key] = events
+		return false, nil
+	}
+	l.events[key] = append(events, now)
+	return true, nil
+}
+
+// sweep 调用方需要持有锁
+func (l *SlidingWindow) sweep(now time.Time) {
+	if now.Before(l.sweepAt) {
+		return
+	}
+	for key, events := range l.events {
+		if len(events) == 0 || !events[len(events)-1].After(now.Add(-l.window)) {
+			delete(l.events, key)
+		}
+	}
+	l.sweepAt = now.Add(l.window)
+}
+
+// TokenBucket 令牌桶限流，每秒补充 rate 个令牌，最多积累 burst 个
+// 令牌已经补满的桶和新建的桶没有区别，定期清理，清理间隔是补满一个空桶的时间
+type TokenBucket struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	option  LimiterOption
+	buckets map[string]*bucket
+	sweepAt time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int, opts ...LimiterOptFun) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), option: newLimiterOption(opts), buckets: map[string]*bucket{}}
+}
+
+func (l *TokenBucket) Allow(key string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.option.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, nil
+	}
+	b.tokens--
+	return true, nil
+}
+
+// sweep 调用方需要持有锁
+func (l *TokenBucket) sweep(now time.Time) {
+	// 不补充令牌时删除桶相当于重置，不能清理
+	if l.rate <= 0 || now.Before(l.sweepAt) {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweepAt = now.Add(time.Duration(l.burst / l.rate * float64(time.Second)))
+}
+
+// MemoryIdempotencyStore 内存中的幂等键
+// 过期的幂等键在 Reserve 时定期清理，清理间隔是最近一次占用的有效期
+type MemoryIdempotencyStore struct {
+	lock    sync.Mutex
+	option  LimiterOption
+	entries map[string]idempotencyEntry
+	sweepAt time.Time
+}
+
+type idempotencyEntry struct {
+	id     string
+	expire time.Time
+}
+
+func NewMemoryIdempotencyStore(opts ...LimiterOptFun) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{option: newLimiterOption(opts), entries: map[string]idempotencyEntry{}}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(key, id string, ttl time.Duration) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.option.now()
+	s.sweep(now, ttl)
+	if e, ok := s.entries[key]; ok && now.Before(e.expire) {
+		return e.id, false, nil
+	}
+	s.entries[key] = idempotencyEntry{id: id, expire: now.Add(ttl)}
+	return id, true, nil
+}
+
+// sweep 调用方需要持有锁
+func (s *MemoryIdempotencyStore) sweep(now time.Time, ttl time.Duration) {
+	if now.Before(s.sweepAt) {
+		return
+	}
+	for key, e := range s.entries {
+		if !now.Before(e.expire) {
+			delete(s.entries, key)
+		}
+	}
+	s.sweepAt = now.Add(ttl)
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// LimitScope 限流的维度
+type LimitScope int
+
+const (
+	// ScopePhone 按手机号限流
+	ScopePhone LimitScope = iota
+	// ScopeTemplate 按模板限流，没有指定模板的发送不受限制
+	ScopeTemplate
+	// ScopePhoneTemplate 按手机号和模板限流
+	ScopePhoneTemplate
+)
+
+type rateLimit struct {
+	scope   LimitScope
+	limiter Limiter
+}
+
+// key 限流的 key，返回 false 表示不适用
+func (r rateLimit) key(phone Phone, template string) (string, bool) {
+	switch r.scope {
+	case ScopePhone:
+		return "phone:" + phone.String(), true
+	case ScopeTemplate:
+		return "template:" + template, template != ""
+	default:
+		return "phone_template:" + phone.String() + ":" + template, template != ""
+	}
+}
+
+// WithRateLimit 按 scope 维度限流，可以设置多个，全部允许才发送
+// 规则按照设置顺序检查，前面的规则已经计入的次数不会因为后面的规则拒绝而退回
+func WithRateLimit(scope LimitScope, limiter Limiter) SMSOptFun {
+	return func(option *SMSOption) {
+		option.limits = append(option.limits, rateLimit{scope: scope, limiter: limiter})
+	}
+}
+
+// WithIdempotency 使用幂等键去重，ttl 内相同幂等键的发送返回 ErrDuplicate
+func WithIdempotency(store IdempotencyStore, ttl time.Duration) SMSOptFun {
+	return func(option *SMSOption) {
+		option.idempotency = store
+		option.idempotencyTTL = ttl
+	}
+}
+
+// SendOption 单次发送的可选参数
+type SendOption struct {
+	template       string
+	idempotencyKey string
+}
+
+type SendOptFun func(option *SendOption)
+
+// WithTemplate 使用的消息模板，用于按模板限流
+func WithTemplate(name string) SendOptFun {
+	return func(option *SendOption) {
+		option.template = name
+	}
+}
+
+// WithIdempotencyKey 幂等键，例如业务流水号
+func WithIdempotencyKey(key string) SendOptFun {
+	return func(option *SendOption) {
+		option.idempotencyKey = key
+	}
+}
+
+// reserve 占用幂等键并绑定消息 ID，返回发送失败时的释放函数
+// 幂等键已经被占用时返回第一次发送的消息 ID 和 ErrDuplicate
+func (s *sms) reserve(key, id string) (string, func(), error) {
+	if s.option.idempotency == nil || key == "" {
+		return id, func() {}, nil
+	}
+	id, ok, err := s.option.idempotency.Reserve(key, id, s.option.idempotencyTTL)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return id, nil, ErrDuplicate
+	}
+	return id, func() { s.option.idempotency.Release(key) }, nil
+}
+
+// allow 依次检查所有限流规则
+func (s *sms) allow(phone Phone, template string) error {
+	for _, limit := range s.option.limits {
+		key, ok := limit.key(phone, template)
+		if !ok {
+			continue
+		}
+		allowed, err := limit.limiter.Allow(key)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrRateLimited
+		}
+	}
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := WithNow(func() time.Time { return now })
+
+	window := NewSlidingWindow(2, time.Minute, clock)
+	for _, want := range []bool{true, true, false} {
+		allowed, err := window.Allow("a")
+		require.NoError(t, err)
+		assert.Equal(t, want, allowed)
+	}
+	allowed, _ := window.Allow("b")
+	assert.True(t, allowed)
+	now = now.Add(time.Minute)
+	allowed, _ = window.Allow("a")
+	assert.True(t, allowed)
+
+	tokens := NewTokenBucket(0.5, 2, clock)
+	for _, want := range []bool{true, true, false} {
+		allowed, err := tokens.Allow("a")
+		require.NoError(t, err)
+		assert.Equal(t, want, allowed)
+	}
+	now = now.Add(2 * time.Second)
+	allowed, _ = tokens.Allow("a")
+	assert.True(t, allowed)
+	allowed, _ = tokens.Allow("a")
+	assert.False(t, allowed)
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := WithNow(func() time.Time { return now })
+
+	window := NewSlidingWindow(1, time.Minute, clock)
+	tokens := NewTokenBucket(1, 10, clock)
+	store := NewMemoryIdempotencyStore(clock)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("+86133%08d", i)
+		window.Allow(key)
+		tokens.Allow(key)
+		store.Reserve(key, key, time.Minute)
+	}
+	assert.Len(t, window.events, 100)
+	assert.Len(t, tokens.buckets, 100)
+	assert.Len(t, store.entries, 100)
+
+	// 过期之后，见过的 key 不再占用内存
+	now = now.Add(time.Minute)
+	window.Allow("a")
+	tokens.Allow("a")
+	store.Reserve("a", "a", time.Minute)
+	assert.Len(t, window.events, 1)
+	assert.Len(t, tokens.buckets, 1)
+	assert.Len(t, store.entries, 1)
+}
+
+func TestSMS_RateLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := WithNow(func() time.Time { return now })
+	failed := errors.New("gateway error")
+	var sent int
+	var fail bool
+	tel := NewTelecomSMS(
+		WithGateway(func(id, content string, phone Phone) error {
+			if fail {
+				return failed
+			}
+			sent++
+			return nil
+		}),
+		WithRateLimit(ScopePhone, NewSlidingWindow(4, time.Hour, clock)),
+		WithRateLimit(ScopePhoneTemplate, NewSlidingWindow(1, time.Minute, clock)),
+		WithIdempotency(NewMemoryIdempotencyStore(clock), 10*time.Minute),
+	)
+	const phone = "+8613312345678"
+	var err error
+
+	// 同一个模板一分钟内只能发送一次
+	_, err = tel.Send("code 1234", phone, WithTemplate("verify_code"))
+	require.NoError(t, err)
+	_, err = tel.Send("code 5678", phone, WithTemplate("verify_code"))
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	_, err = tel.Send("welcome", phone, WithTemplate("welcome"))
+	require.NoError(t, err)
+
+	// 相同的幂等键被忽略，并且不计入限流，重试时返回第一次发送的消息 ID
+	id, err := tel.Send("order shipped", phone, WithIdempotencyKey("order-1"))
+	require.NoError(t, err)
+	retried, err := tel.Send("order shipped", phone, WithIdempotencyKey("order-1"))
+	assert.True(t, errors.Is(err, ErrDuplicate))
+	assert.NotEmpty(t, id)
+	assert.Equal(t, id, retried)
+	assert.Equal(t, 3, sent)
+
+	// 每小时最多四次，被按模板限流拒绝的那次也计入
+	now = now.Add(2 * time.Minute)
+	_, err = tel.Send("code 1234", phone, WithTemplate("verify_code"))
+	assert.True(t, errors.Is(err, ErrRateLimited))
+
+	// 发送失败时释放幂等键，可以重试
+	now = now.Add(time.Hour)
+	fail = true
+	_, err = tel.Send("order paid", phone, WithIdempotencyKey("order-2"))
+	assert.True(t, errors.Is(err, failed))
+	fail = false
+	_, err = tel.Send("order paid", phone, WithIdempotencyKey("order-2"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, sent)
+}
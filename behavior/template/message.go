@@ -0,0 +1,341 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 消息模板
+// 模板内容使用 {{name}} 引用参数，参数需要在 Params 中声明类型，例如：
+//   "您的验证码是 {{code}}，{{minutes}} 分钟内有效"
+// 同一个模板可以有多个语言版本，每个版本必须引用全部参数，避免翻译时遗漏
+// 渲染时缺少参数、多余参数、类型不匹配都会返回错误
+
+var (
+	// ErrTemplateNotFound 模板不存在
+	ErrTemplateNotFound = errors.New("message template not found")
+	// ErrInvalidVars 参数与模板声明不一致
+	ErrInvalidVars = errors.New("invalid template vars")
+)
+
+// ParamType 参数类型
+type ParamType string
+
+const (
+	TypeString ParamType = "string"
+	TypeInt    ParamType = "int"
+	// TypeDigits 纯数字的字符串或者非负整数，例如验证码，保留前导 0
+	TypeDigits ParamType = "digits"
+)
+
+// Vars 渲染参数
+type Vars map[string]any
+
+// Message 消息模板
+type Message struct {
+	Name   string               `json:"name"`
+	Params map[string]ParamType `json:"params"`
+	// Locales 各语言版本的内容，key 为语言，例如 zh、zh-TW、en
+	Locales map[string]string `json:"locales"`
+	// DefaultLocale 找不到对应语言时使用的版本
+	DefaultLocale string `json:"default_locale"`
+}
+
+// part 编译后的模板片段，param 为空时是普通文本
+type part struct {
+	text  string
+	param string
+}
+
+type compiledMessage struct {
+	Message
+	locales map[string][]part
+}
+
+var placeholder = regexp.MustCompile(`{{\s*([A-Za-z_][A-Za-z0-9_]*)\s*}}`)
+
+// Registry 消息模板注册表，并发安全
+type Registry struct {
+	lock     sync.RWMutex
+	messages map[string]*compiledMessage
+}
+
+func NewRegistry() *Registry {
+	return &Registry{messages: map[string]*compiledMessage{}}
+}
+
+// Register 注册模板，同名模板会被覆盖
+func (r *Registry) Register(m Message) error {
+	compiled, err := compile(m)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.messages[m.Name] = compiled
+	return nil
+}
+
+func compile(m Message) (*compiledMessage, error) {
+	if m.Name == "" {
+		return nil, errors.New("message template name is empty")
+	}
+	for name, typ := range m.Params {
+		switch typ {
+		case TypeString, TypeInt, TypeDigits:
+		default:
+			return nil, fmt.Errorf("template %s: param %s has unknown type %q", m.Name, name, typ)
+		}
+	}
+	if _, ok := m.Locales[m.DefaultLocale]; !ok {
+		return nil, fmt.Errorf("template %s: default locale %q not found", m.Name, m.DefaultLocale)
+	}
+
+	compiled := &compiledMessage{Message: m, locales: map[string][]part{}}
+	var errs []error
+	for locale, text := range m.Locales {
+		parts, used := parse(text)
+		for name := range used {
+			if _, ok := m.Params[name]; !ok {
+				errs = append(errs, fmt.Errorf("template %s[%s]: param %s is not declared", m.Name, locale, name))
+			}
+		}
+		for name := range m.Params {
+			if !used[name] {
+				errs = append(errs, fmt.Errorf("template %s[%s]: param %s is not used", m.Name, locale, name))
+			}
+		}
+		compiled.locales[locale] = parts
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return compiled, nil
+}
+
+func parse(text string) ([]part, map[string]bool) {
+	var parts []part
+	used := map[string]bool{}
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(text, -1) {
+		if loc[0] > last {
+			parts = append(parts, part{text: text[last:loc[0]]})
+		}
+		name := text[loc[2]:loc[3]]
+		parts = append(parts, part{param: name})
+		used[name] = true
+		last = loc[1]
+	}
+	if last < len(text) {
+		parts = append(parts, part{text: text[last:]})
+	}
+	return parts, used
+}
+
+// Render 渲染模板，locale 找不到时依次尝试去掉地区的语言（zh-CN -> zh）和默认语言
+func (r *Registry) Render(name, locale string, vars Vars) (string, error) {
+	r.lock.RLock()
+	m, ok := r.messages[name]
+	r.lock.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	values, err := m.format(vars)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, p := range m.lookup(locale) {
+		if p.param == "" {
+			b.WriteString(p.text)
+		} else {
+			b.WriteString(values[p.param])
+		}
+	}
+	return b.String(), nil
+}
+
+func (m *compiledMessage) lookup(locale string) []part {
+	if parts, ok := m.locales[locale]; ok {
+		return parts
+	}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if parts, ok := m.locales[locale[:i]]; ok {
+			return parts
+		}
+	}
+	return m.locales[m.DefaultLocale]
+}
+
+// format 校验参数并转换为字符串
+func (m *compiledMessage) format(vars Vars) (map[string]string, error) {
+	var errs []error
+	values := make(map[string]string, len(vars))
+	for name, typ := range m.Params {
+		v, ok := vars[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("missing %s", name))
+			continue
+		}
+		s, err := formatValue(typ, v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		values[name] = s
+	}
+	for name := range vars {
+		if _, ok := m.Params[name]; !ok {
+			errs = append(errs, fmt.Errorf("unexpected %s", name))
+		}
+	}
+	if len(errs) > 0 {
+		// 错误顺序固定，方便排查
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return nil, fmt.Errorf("%w for template %s: %w", ErrInvalidVars, m.Name, errors.Join(errs...))
+	}
+	return values, nil
+}
+
+func formatValue(typ ParamType, v any) (string, error) {
+	switch typ {
+	case TypeString:
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case fmt.Stringer:
+			return v.String(), nil
+		}
+	case TypeInt:
+		if i, ok := toInt(v); ok {
+			return strconv.FormatInt(i, 10), nil
+		}
+	case TypeDigits:
+		if i, ok := toInt(v); ok && i >= 0 {
+			return strconv.FormatInt(i, 10), nil
+		}
+		if s, ok := v.(string); ok && s != "" && strings.Trim(s, "0123456789") == "" {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("%v is not %s", v, typ)
+}
+
+func toInt(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// Sender 可以发送短信的通道，TelecomSMS、Router 等都满足
+type Sender interface {
+	Valid(content string) error
+	Send(content string, phone string, opts ...SendOptFun) (string, error)
+}
+
+// Send 渲染模板并发送，发送之前按照通道的限制检查渲染后的长度，发送时带上模板名用于限流，返回消息 ID
+func (r *Registry) Send(sender Sender, phone, name, locale string, vars Vars, opts ...SendOptFun) (string, error) {
+	content, err := r.Render(name, locale, vars)
+	if err != nil {
+		return "", err
+	}
+	if err := sender.Valid(content); err != nil {
+		return "", fmt.Errorf("template %s[%s]: %w", name, locale, err)
+	}
+	return sender.Send(content, phone, append([]SendOptFun{WithTemplate(name)}, opts...)...)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register(Message{
+		Name:   "verify_code",
+		Params: map[string]ParamType{"code": TypeDigits, "minutes": TypeInt},
+		Locales: map[string]string{
+			"zh": "您的验证码是 {{code}}，{{ minutes }} 分钟内有效",
+			"en": "Your code is {{code}}, valid {{minutes}} minutes",
+		},
+		DefaultLocale: "zh",
+	}))
+
+	tests := []struct {
+		name   string
+		locale string
+		vars   Vars
+		want   string
+		err    string
+	}{
+		{name: "zh", locale: "zh-CN", vars: Vars{"code": "0123", "minutes": 5}, want: "您的验证码是 0123，5 分钟内有效"},
+		{name: "en", locale: "en", vars: Vars{"code": 4567, "minutes": int64(10)}, want: "Your code is 4567, valid 10 minutes"},
+		{name: "default", locale: "ja", vars: Vars{"code": "8", "minutes": 1}, want: "您的验证码是 8，1 分钟内有效"},
+		{name: "missing", locale: "en", vars: Vars{"code": "1"}, err: "missing minutes"},
+		{name: "extra", locale: "en", vars: Vars{"code": "1", "minutes": 1, "name": "bob"}, err: "unexpected name"},
+		{name: "type", locale: "en", vars: Vars{"code": "12a", "minutes": "5"}, err: "12a is not digits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Render("verify_code", tt.locale, tt.vars)
+			if tt.err != "" {
+				assert.True(t, errors.Is(err, ErrInvalidVars))
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := r.Render("unknown", "zh", nil)
+	assert.True(t, errors.Is(err, ErrTemplateNotFound))
+
+	// 翻译遗漏参数、引用未声明的参数
+	err = r.Register(Message{
+		Name:          "notice",
+		Params:        map[string]ParamType{"name": TypeString},
+		Locales:       map[string]string{"zh": "{{name}} 你好", "en": "Hello {{user}}"},
+		DefaultLocale: "zh",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "param user is not declared")
+	assert.Contains(t, err.Error(), "param name is not used")
+
+	// 发送之前检查渲染后的长度
+	var sent []string
+	tel := NewTelecomSMS(WithGateway(func(id, content string, phone Phone) error {
+		sent = append(sent, content)
+		return nil
+	}))
+	_, err = r.Send(tel, "+8613312345678", "verify_code", "en", Vars{"code": "1234", "minutes": 5})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Your code is 1234, valid 5 minutes"}, sent)
+	_, err = r.Send(tel, "+8613312345678", "verify_code", "zh", Vars{"code": strings.Repeat("1", 60), "minutes": 5})
+	assert.True(t, errors.Is(err, ErrContentTooLong))
+	assert.Contains(t, err.Error(), "verify_code[zh]")
+	assert.Len(t, sent, 1)
+}
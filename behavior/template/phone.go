@@ -0,0 +1,132 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 手机号校验
+// 手机号统一使用 E.164 格式："+" 国家码 号码，最多 15 位数字，例如 +8613912345678
+// 已登记的国家按照各自的号码长度和号段校验，未登记的国家只校验 E.164 格式
+
+// ErrInvalidPhone 手机号格式错误
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// Phone E.164 手机号
+type Phone struct {
+	// CountryCode 国家码，不含 "+"
+	CountryCode string
+	// Number 国内号码
+	Number string
+}
+
+func (p Phone) String() string {
+	return "+" + p.CountryCode + p.Number
+}
+
+// CountryRule 国家的手机号规则
+type CountryRule struct {
+	CountryCode string
+	// Length 国内号码的位数
+	Length int
+	// Prefixes 手机号段，为空表示不限制
+	Prefixes []string
+}
+
+var (
+	countryLock  sync.RWMutex
+	countryRules = map[string]CountryRule{}
+)
+
+func init() {
+	RegisterCountry(CountryRule{CountryCode: "86", Length: 11, Prefixes: []string{"13", "14", "15", "16", "17", "18", "19"}})
+	RegisterCountry(CountryRule{CountryCode: "1", Length: 10})
+	RegisterCountry(CountryRule{CountryCode: "44", Length: 10, Prefixes: []string{"7"}})
+	RegisterCountry(CountryRule{CountryCode: "81", Length: 10, Prefixes: []string{"70", "80", "90"}})
+}
+
+// RegisterCountry 登记国家的手机号规则，已存在时覆盖
+func RegisterCountry(rule CountryRule) {
+	countryLock.Lock()
+	defer countryLock.Unlock()
+	countryRules[rule.CountryCode] = rule
+}
+
+// ParsePhone 解析 E.164 格式的手机号
+func ParsePhone(s string) (Phone, error) {
+	digits, ok := strings.CutPrefix(s, "+")
+	if !ok || len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return Phone{}, fmt.Errorf("%w: %q is not E.164", ErrInvalidPhone, s)
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Phone{}, fmt.Errorf("%w: %q is not E.164", ErrInvalidPhone, s)
+		}
+	}
+
+	countryLock.RLock()
+	defer countryLock.RUnlock()
+	// 国家码 1 到 3 位，且不会互为前缀
+	for i := 1; i <= 3; i++ {
+		rule, ok := countryRules[digits[:i]]
+		if !ok {
+			continue
+		}
+		phone := Phone{CountryCode: digits[:i], Number: digits[i:]}
+		if len(phone.Number) != rule.Length {
+			return Phone{}, fmt.Errorf("%w: %s should have %d digits", ErrInvalidPhone, phone, rule.Length)
+		}
+		if len(rule.Prefixes) > 0 && !hasAnyPrefix(phone.Number, rule.Prefixes) {
+			return Phone{}, fmt.Errorf("%w: %s is not a mobile number", ErrInvalidPhone, phone)
+		}
+		return phone, nil
+	}
+	// 未登记的国家无法区分国家码和号码
+	return Phone{Number: digits}, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestParsePhone(t *testing.T) {
+	tests := []struct {
+		phone   string
+		want    Phone
+		wantErr bool
+	}{
+		{phone: "+8613912345678", want: Phone{CountryCode: "86", Number: "13912345678"}},
+		{phone: "+14155552671", want: Phone{CountryCode: "1", Number: "4155552671"}},
+		{phone: "+447911123456", want: Phone{CountryCode: "44", Number: "7911123456"}},
+		{phone: "+61412345678", want: Phone{Number: "61412345678"}},
+		{phone: "13912345678", wantErr: true},
+		{phone: "+86139123456789", wantErr: true},
+		{phone: "+8602112345678", wantErr: true},
+		{phone: "+441611234567", wantErr: true},
+		{phone: "+86139-1234-567", wantErr: true},
+		{phone: "+1234567890123456", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phone, func(t *testing.T) {
+			got, err := ParsePhone(tt.phone)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidPhone))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.phone, got.String())
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package template
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 步骤流水线
+// Go 没有继承，用嵌套结构体模拟"父类调用子类方法"比较别扭，Pipeline 用组合的方式实现模板方法：
+// 算法骨架按顺序声明步骤，可以被覆盖的步骤用 Override 替换，必须由使用方实现的步骤用 Abstract 声明
+// 钩子在每个步骤之前、之后、出错时调用，可以用来做日志、统计、回滚等横切逻辑
+//
+// Step、StepFunc、Abstract 在定义骨架时使用，直接修改流水线
+// Override、With 返回新的流水线，骨架本身不变，可以被多个"子类"共享
+
+var (
+	// ErrAbstractStep 抽象步骤没有被覆盖
+	ErrAbstractStep = errors.New("abstract step is not overridden")
+	// ErrStop 步骤返回 ErrStop 时流水线提前结束，Run 返回 nil
+	ErrStop = errors.New("stop pipeline")
+)
+
+// Step 流水线中的一个步骤
+type Step[T any] interface {
+	Run(ctx context.Context, data T) error
+}
+
+// StepFunc 函数形式的 Step
+type StepFunc[T any] func(ctx context.Context, data T) error
+
+func (f StepFunc[T]) Run(ctx context.Context, data T) error {
+	return f(ctx, data)
+}
+
+// Hook 步骤之前、之后调用的钩子，返回错误时按照步骤出错处理
+type Hook[T any] func(ctx context.Context, step string, data T) error
+
+// ErrorHook 步骤出错时调用，返回值替换原来的错误，返回 nil 表示已经处理，继续执行下一个步骤
+type ErrorHook[T any] func(ctx context.Context, step string, data T, err error) error
+
+// PipelineOption 流水线的钩子
+type PipelineOption[T any] struct {
+	before  []Hook[T]
+	after   []Hook[T]
+	onError []ErrorHook[T]
+}
+
+type PipelineOptFun[T any] func(option *PipelineOption[T])
+
+// WithBefore 每个步骤之前调用
+func WithBefore[T any](hook Hook[T]) PipelineOptFun[T] {
+	return func(option *PipelineOption[T]) {
+		option.before = append(option.before, hook)
+	}
+}
+
+// WithAfter 每个步骤成功之后调用
+func WithAfter[T any](hook Hook[T]) PipelineOptFun[T] {
+	return func(option *PipelineOption[T]) {
+		option.after = append(option.after, hook)
+	}
+}
+
+// WithOnError 步骤出错时调用，多个钩子依次调用，前一个的返回值作为后一个的参数
+// 某个钩子返回 nil 表示错误已经处理，后面的钩子不再调用
+func WithOnError[T any](hook ErrorHook[T]) PipelineOptFun[T] {
+	return func(option *PipelineOption[T]) {
+		option.onError = append(option.onError, hook)
+	}
+}
+
+type stage[T any] struct {
+	name string
+	step Step[T]
+}
+
+// Pipeline 步骤流水线
+type Pipeline[T any] struct {
+	stages []stage[T]
+	option PipelineOption[T]
+}
+
+func NewPipeline[T any](opts ...PipelineOptFun[T]) *Pipeline[T] {
+	p := &Pipeline[T]{}
+	for _, opt := range opts {
+		opt(&p.option)
+	}
+	return p
+}
+
+// Step 在末尾添加步骤，名字不能重复
+func (p *Pipeline[T]) Step(name string, step Step[T]) *Pipeline[T] {
+	if p.index(name) >= 0 {
+		panic(fmt.Sprintf("duplicate step: %s", name))
+	}
+	p.stages = append(p.stages, stage[T]{name: name, step: step})
+	return p
+}
+
+// StepFunc 在末尾添加函数形式的步骤
+func (p *Pipeline[T]) StepFunc(name string, fn func(ctx context.Context, data T) error) *Pipeline[T] {
+	return p.Step(name, StepFunc[T](fn))
+}
+
+// Abstract 在末尾添加抽象步骤，运行之前必须用 Override 实现
+func (p *Pipeline[T]) Abstract(name string) *Pipeline[T] {
+	return p.Step(name, nil)
+}
+
+// Override 替换步骤，返回新的流水线
+func (p *Pipeline[T]) Override(name string, step Step[T]) (*Pipeline[T], error) {
+	i := p.index(name)
+	if i < 0 {
+		return nil, fmt.Errorf("step not found: %s", name)
+	}
+	c := p.clone()
+	c.stages[i].step = step
+	return c, nil
+}
+
+// With 添加钩子，返回新的流水线
+func (p *Pipeline[T]) With(opts ...PipelineOptFun[T]) *Pipeline[T] {
+	c := p.clone()
+	for _, opt := range opts {
+		opt(&c.option)
+	}
+	return c
+}
+
+// Steps 步骤的名字，按照执行顺序排列
+func (p *Pipeline[T]) Steps() []string {
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.name
+	}
+	return names
+}
+
+// Run 按顺序执行所有步骤，某个步骤出错并且没有被 ErrorHook 处理时停止
+// ctx 取消、步骤没有实现时和步骤出错一样调用 ErrorHook，钩子可以借此回滚已经执行的步骤
+// ctx 取消时即使钩子返回 nil 也会停止，返回 ctx 的错误
+func (p *Pipeline[T]) Run(ctx context.Context, data T) error {
+	for _, s := range p.stages {
+		err := ctx.Err()
+		cancelled := err != nil
+		if err == nil && s.step == nil {
+			err = fmt.Errorf("%w: %s", ErrAbstractStep, s.name)
+		}
+		if err == nil {
+			err = p.run(ctx, s, data)
+			if errors.Is(err, ErrStop) {
+				return nil
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		for _, hook := range p.option.onError {
+			if err = hook(ctx, s.name, data, err); err == nil {
+				break
+			}
+		}
+		if err == nil && cancelled {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline[T]) run(ctx context.Context, s stage[T], data T) error {
+	for _, hook := range p.option.before {
+		if err := hook(ctx, s.name, data); err != nil {
+			return err
+		}
+	}
+	if err := s.step.Run(ctx, data); err != nil {
+		return err
+	}
+	for _, hook := range p.option.after {
+		if err := hook(ctx, s.name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline[T]) index(name string) int {
+	for i, s := range p.stages {
+		if s.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Pipeline[T]) clone() *Pipeline[T] {
+	return &Pipeline[T]{
+		stages: append([]stage[T](nil), p.stages...),
+		option: PipelineOption[T]{
+			before:  append([]Hook[T](nil), p.option.before...),
+			after:   append([]Hook[T](nil), p.option.after...),
+			onError: append([]ErrorHook[T](nil), p.option.onError...),
+		},
+	}
+}
+
+// upperStep 实现 Step 接口的步骤
+type upperStep struct{}
+
+func (upperStep) Run(ctx context.Context, data *[]string) error {
+	*data = append(*data, "UPPER")
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	appendStep := func(s string) func(ctx context.Context, data *[]string) error {
+		return func(ctx context.Context, data *[]string) error {
+			*data = append(*data, s)
+			return nil
+		}
+	}
+	failed := errors.New("failed")
+
+	skeleton := NewPipeline[*[]string](
+		WithBefore(func(ctx context.Context, step string, data *[]string) error {
+			*data = append(*data, "before "+step)
+			return nil
+		}),
+	).
+		StepFunc("open", appendStep("open")).
+		Abstract("process").
+		StepFunc("close", appendStep("close"))
+	assert.Equal(t, []string{"open", "process", "close"}, skeleton.Steps())
+
+	var data []string
+	assert.True(t, errors.Is(skeleton.Run(context.Background(), &data), ErrAbstractStep))
+	assert.Equal(t, []string{"before open", "open"}, data)
+
+	// 覆盖抽象步骤，骨架本身不变
+	impl, err := skeleton.Override("process", upperStep{})
+	require.NoError(t, err)
+	data = nil
+	require.NoError(t, impl.Run(context.Background(), &data))
+	assert.Equal(t, []string{"before open", "open", "before process", "UPPER", "before close", "close"}, data)
+	_, err = skeleton.Override("unknown", upperStep{})
+	assert.Error(t, err)
+
+	// 出错时调用钩子，钩子可以处理错误继续执行
+	var failedSteps []string
+	recovering, err := impl.Override("process", StepFunc[*[]string](func(ctx context.Context, data *[]string) error {
+		return failed
+	}))
+	require.NoError(t, err)
+	recovering = recovering.With(WithOnError(func(ctx context.Context, step string, data *[]string, err error) error {
+		failedSteps = append(failedSteps, step)
+		return nil
+	}))
+	data = nil
+	require.NoError(t, recovering.Run(context.Background(), &data))
+	assert.Equal(t, []string{"process"}, failedSteps)
+	assert.Equal(t, []string{"before open", "open", "before process", "before close", "close"}, data)
+
+	// 错误已经处理，后面的钩子不再调用
+	handled := recovering.With(WithOnError(func(ctx context.Context, step string, data *[]string, err error) error {
+		return err
+	}))
+	failedSteps = nil
+	require.NoError(t, handled.Run(context.Background(), &data))
+	assert.Equal(t, []string{"process"}, failedSteps)
+
+	// 前面的钩子没有处理，后面的钩子收到包装后的错误
+	wrapped, err := impl.Override("process", StepFunc[*[]string](func(ctx context.Context, data *[]string) error {
+		return failed
+	}))
+	require.NoError(t, err)
+	wrapped = wrapped.With(
+		WithOnError(func(ctx context.Context, step string, data *[]string, err error) error {
+			return fmt.Errorf("rollback %s: %w", step, err)
+		}),
+		WithOnError(func(ctx context.Context, step string, data *[]string, err error) error {
+			require.Error(t, err)
+			return err
+		}),
+	)
+	assert.True(t, errors.Is(wrapped.Run(context.Background(), &data), failed))
+
+	// 提前结束
+	stopping, err := impl.Override("process", StepFunc[*[]string](func(ctx context.Context, data *[]string) error {
+		return ErrStop
+	}))
+	require.NoError(t, err)
+	data = nil
+	require.NoError(t, stopping.Run(context.Background(), &data))
+	assert.Equal(t, []string{"before open", "open", "before process"}, data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, errors.Is(impl.Run(ctx, &data), context.Canceled))
+
+	// 两个步骤之间取消，后面的步骤不再执行，出错钩子仍然会被调用
+	var rollbacks []string
+	ctx, cancel = context.WithCancel(context.Background())
+	cancelling := NewPipeline[*[]string](WithOnError(func(ctx context.Context, step string, data *[]string, err error) error {
+		rollbacks = append(rollbacks, step+": "+err.Error())
+		return nil
+	})).
+		StepFunc("reserve", func(ctx context.Context, data *[]string) error {
+			*data = append(*data, "reserve")
+			cancel()
+			return nil
+		}).
+		StepFunc("send", appendStep("send")).
+		Abstract("track")
+	data = nil
+	assert.True(t, errors.Is(cancelling.Run(ctx, &data), context.Canceled))
+	assert.Equal(t, []string{"reserve"}, data)
+	assert.Equal(t, []string{"send: context canceled"}, rollbacks)
+
+	// 没有实现的步骤同样调用出错钩子
+	rollbacks = nil
+	data = nil
+	assert.True(t, errors.Is(skeleton.With(WithOnError(func(ctx context.Context, step string, data *[]string, err error) error {
+		rollbacks = append(rollbacks, step)
+		return err
+	})).Run(context.Background(), &data), ErrAbstractStep))
+	assert.Equal(t, []string{"process"}, rollbacks)
+	assert.Panics(t, func() { skeleton.StepFunc("open", appendStep("open")) })
+}
@@ -0,0 +1,112 @@
+package template
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 多通道路由
+// Router 同样是一个短信"子类"，复用 Send 的校验流程，只是把发送步骤替换为在多个通道之间选择
+// 优先使用号码所属运营商的通道，其余通道按照注册顺序作为备用，发送失败时依次切换
+
+// ErrNoCarrier 没有可以发送到该号码的通道
+var ErrNoCarrier = errors.New("no carrier available")
+
+// Router 多通道路由
+type Router struct {
+	*sms
+	carriers []Carrier
+}
+
+// NewRouter carriers 按照优先级排列
+func NewRouter(carriers []Carrier, opts ...SMSOptFun) *Router {
+	r := &Router{carriers: carriers}
+	r.sms = newSMS(r, opts...)
+	return r
+}
+
+// route 可以发送到该号码的通道，所属运营商排在最前面
+func (r *Router) route(phone Phone) []Carrier {
+	owner := ChinaCarrier(phone)
+	var owned, others []Carrier
+	for _, c := range r.carriers {
+		if !c.Supports(phone) {
+			continue
+		}
+		if c.Name() == owner {
+			owned = append(owned, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+	return append(owned, others...)
+}
+
+func (r *Router) send(id, content string, phone Phone) error {
+	carriers := r.route(phone)
+	if len(carriers) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoCarrier, phone)
+	}
+
+	var errs []error
+	for _, c := range carriers {
+		// 各个通道的长度限制可能不同
+		if err := c.Valid(content); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+			continue
+		}
+		if err := c.send(id, content, phone); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+			continue
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func TestRouter(t *testing.T) {
+	var sent []string
+	gateway := func(name string, err error) SMSOptFun {
+		return WithGateway(func(id, content string, phone Phone) error {
+			sent = append(sent, name)
+			return err
+		})
+	}
+	down := errors.New("gateway timeout")
+	router := NewRouter([]Carrier{
+		NewTelecomSMS(gateway("telecom", down)),
+		NewMobileSMS(gateway("mobile", nil)),
+		NewUnicomSMS(gateway("unicom", nil), WithMaxSegments(2)),
+	}, WithMaxSegments(2))
+
+	// 联通号码优先走联通
+	_, err := router.Send("验证码 1234", "+8618612345678")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unicom"}, sent)
+
+	// 电信通道故障，切换到移动
+	sent = nil
+	_, err = router.Send("验证码 1234", "+8613312345678")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"telecom", "mobile"}, sent)
+
+	// 只有联通允许两条，其他通道因为超长被跳过
+	sent = nil
+	_, err = router.Send(fmt.Sprintf("%071d", 0)+"验", "+8613312345678")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unicom"}, sent)
+
+	// 所有通道都失败
+	sent = nil
+	_, err = NewRouter([]Carrier{NewTelecomSMS(gateway("telecom", down))}).Send("验证码", "+8613912345678")
+	assert.True(t, errors.Is(err, down))
+	assert.Contains(t, err.Error(), "telecom")
+
+	// 国内通道不能发送国际短信
+	_, err = router.Send("code 1234", "+14155552671")
+	assert.True(t, errors.Is(err, ErrNoCarrier))
+}
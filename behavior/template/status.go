@@ -0,0 +1,308 @@
+package template
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 发送状态
+// Send 为每条短信生成消息 ID，并传给运营商接口，运营商回调状态报告时带回该 ID
+// 状态只会向前推进：queued -> sent -> delivered/failed，回调先于发送结果到达时不会被覆盖
+
+// ErrMessageNotFound 消息不存在
+var ErrMessageNotFound = errors.New("message not found")
+
+// Status 短信状态
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusSent      Status = "sent"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// rank 状态的先后顺序，delivered 和 failed 都是最终状态
+func (s Status) rank() int {
+	switch s {
+	case StatusQueued:
+		return 0
+	case StatusSent:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Record 短信记录
+type Record struct {
+	ID       string
+	Phone    string
+	Content  string
+	Template string
+	// Carrier 实际发送的通道，收到状态报告后填写
+	Carrier   string
+	Status    Status
+	Error     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Query 查询条件，为空的条件表示不限制，时间范围是 [From, To)
+type Query struct {
+	Phone string
+	From  time.Time
+	To    time.Time
+}
+
+// StatusStore 短信状态存储
+type StatusStore interface {
+	Create(record Record) error
+	// Update 更新状态，不会回退到更早的状态
+	Update(id string, update func(record *Record)) error
+	Get(id string) (Record, error)
+	// Query 按照创建时间排序
+	Query(query Query) ([]Record, error)
+}
+
+// StatusStoreOption 状态存储的可选参数
+type StatusStoreOption struct {
+	now func() time.Time
+}
+
+type StatusStoreOptFun func(option *StatusStoreOption)
+
+// WithStatusClock 替换时钟，用于测试
+func WithStatusClock(now func() time.Time) StatusStoreOptFun {
+	return func(option *StatusStoreOption) {
+		option.now = now
+	}
+}
+
+// MemoryStatusStore 内存中的短信状态
+type MemoryStatusStore struct {
+	lock    sync.RWMutex
+	option  StatusStoreOption
+	records map[string]*Record
+}
+
+func NewMemoryStatusStore(opts ...StatusStoreOptFun) *MemoryStatusStore {
+	option := StatusStoreOption{now: time.Now}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	return &MemoryStatusStore{option: option, records: map[string]*Record{}}
+}
+
+func (s *MemoryStatusStore) Create(record Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.records[record.ID]; ok {
+		return fmt.Errorf("message %s already exists", record.ID)
+	}
+	if record.CreatedAt.IsZero() {
+		record.CreatedAt = s.option.now()
+	}
+	record.UpdatedAt = record.CreatedAt
+	s.records[record.ID] = &record
+	return nil
+}
+
+func (s *MemoryStatusStore) Update(id string, update func(record *Record)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, ok := s.records[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+	}
+	updated := *record
+	update(&updated)
+	if updated.Status.rank() <= record.Status.rank() && updated.Status != record.Status {
+		return nil
+	}
+	updated.UpdatedAt = s.option.now()
+	*record = updated
+	return nil
+}
+
+func (s *MemoryStatusStore) Get(id string) (Record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	record, ok := s.records[id]
+	if !ok {
+		return Record{}, fmt.Errorf("%w: %s", ErrMessageNotFound, id)
+	}
+	return *record, nil
+}
+
+func (s *MemoryStatusStore) Query(query Query) ([]Record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var records []Record
+	for _, record := range s.records {
+		if query.Phone != "" && record.Phone != query.Phone {
+			continue
+		}
+		if !query.From.IsZero() && record.CreatedAt.Before(query.From) {
+			continue
+		}
+		if !query.To.IsZero() && !record.CreatedAt.Before(query.To) {
+			continue
+		}
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].CreatedAt.Equal(records[j].CreatedAt) {
+			return records[i].CreatedAt.Before(records[j].CreatedAt)
+		}
+		return records[i].ID < records[j].ID
+	})
+	return records, nil
+}
+
+// DeliveryReport 运营商回调的状态报告
+type DeliveryReport struct {
+	MessageID string
+	Carrier   string
+	// Status 只能是 StatusDelivered 或 StatusFailed
+	Status Status
+	Error  string
+}
+
+// ReportHandler 处理运营商的状态报告，各运营商的回调接口解析报文之后调用
+type ReportHandler interface {
+	HandleReport(report DeliveryReport) error
+}
+
+// ReportHandlerFunc 函数形式的 ReportHandler
+type ReportHandlerFunc func(report DeliveryReport) error
+
+func (f ReportHandlerFunc) HandleReport(report DeliveryReport) error {
+	return f(report)
+}
+
+// NewReportHandler 将状态报告更新到 store
+func NewReportHandler(store StatusStore) ReportHandler {
+	return ReportHandlerFunc(func(report DeliveryReport) error {
+		if report.Status != StatusDelivered && report.Status != StatusFailed {
+			return fmt.Errorf("invalid report status: %s", report.Status)
+		}
+		return store.Update(report.MessageID, func(record *Record) {
+			record.Status = report.Status
+			record.Carrier = report.Carrier
+			record.Error = report.Error
+		})
+	})
+}
+
+// WithStatusStore 记录每条短信的状态
+func WithStatusStore(store StatusStore) SMSOptFun {
+	return func(option *SMSOption) {
+		option.statusStore = store
+	}
+}
+
+// WithIDGenerator 替换消息 ID 的生成方式，默认是 16 字节的随机数
+func WithIDGenerator(generate func() string) SMSOptFun {
+	return func(option *SMSOption) {
+		option.generateID = generate
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// track 记录发送状态，没有设置 StatusStore 时不做任何事情
+func (s *sms) track(id string, update func(record *Record)) error {
+	if s.option.statusStore == nil {
+		return nil
+	}
+	return s.option.statusStore.Update(id, update)
+}
+
+func TestSMS_Status(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := NewMemoryStatusStore(WithStatusClock(func() time.Time { return now }))
+	failed := errors.New("gateway error")
+	var ids []string
+	seq := 0
+	tel := NewTelecomSMS(
+		WithStatusStore(store),
+		WithIDGenerator(func() string {
+			seq++
+			return fmt.Sprintf("msg-%d", seq)
+		}),
+		WithGateway(func(id, content string, phone Phone) error {
+			ids = append(ids, id)
+			if content == "fail" {
+				return failed
+			}
+			return nil
+		}),
+	)
+	handler := NewReportHandler(store)
+
+	id, err := tel.Send("code 1234", "+8613312345678")
+	require.NoError(t, err)
+	assert.Equal(t, "msg-1", id)
+	assert.Equal(t, []string{"msg-1"}, ids)
+	record, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSent, record.Status)
+	assert.Equal(t, "+8613312345678", record.Phone)
+
+	require.NoError(t, handler.HandleReport(DeliveryReport{MessageID: id, Carrier: "telecom", Status: StatusDelivered}))
+	// 重复或者乱序的报告不会回退状态
+	require.NoError(t, handler.HandleReport(DeliveryReport{MessageID: id, Carrier: "telecom", Status: StatusFailed}))
+	require.NoError(t, store.Update(id, func(record *Record) { record.Status = StatusSent }))
+	record, _ = store.Get(id)
+	assert.Equal(t, StatusDelivered, record.Status)
+	assert.Equal(t, "telecom", record.Carrier)
+
+	now = now.Add(time.Minute)
+	id, err = tel.Send("fail", "+8613312345678")
+	assert.True(t, errors.Is(err, failed))
+	assert.Equal(t, "msg-2", id)
+	record, _ = store.Get(id)
+	assert.Equal(t, StatusFailed, record.Status)
+	assert.Equal(t, "gateway error", record.Error)
+
+	now = now.Add(time.Minute)
+	_, err = tel.Send("hello", "+8613912345678")
+	require.NoError(t, err)
+
+	// 按手机号、时间范围查询
+	records, err := store.Query(Query{Phone: "+8613312345678"})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "msg-1", records[0].ID)
+	records, err = store.Query(Query{From: time.Unix(1000, 0).Add(time.Minute), To: now})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "msg-2", records[0].ID)
+
+	// 校验失败的短信不生成记录
+	_, err = tel.Send("code", "13312345678")
+	assert.Error(t, err)
+	records, _ = store.Query(Query{})
+	assert.Len(t, records, 3)
+
+	assert.True(t, errors.Is(handler.HandleReport(DeliveryReport{MessageID: "unknown", Status: StatusDelivered}), ErrMessageNotFound))
+	assert.Error(t, handler.HandleReport(DeliveryReport{MessageID: "msg-3", Status: StatusQueued}))
+}
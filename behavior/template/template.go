@@ -8,8 +8,15 @@
 package template
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // 实现一个短信推送的系统的例子
@@ -18,46 +25,276 @@ import (
 // 发送短信
 // 返回状态
 
+// ErrContentTooLong 短信超长
+var ErrContentTooLong = errors.New("短信超长")
+
 type ISMS interface{
-	send(content string, phone int) error
+	send(id, content string, phone Phone) error
+}
+
+// Gateway 实际调用运营商接口发送短信，id 是消息 ID，运营商的状态报告会带回该 ID
+type Gateway func(id, content string, phone Phone) error
+
+// SMSOption 短信的可选参数
+type SMSOption struct {
+	maxSegments    int
+	gateway        Gateway
+	limits         []rateLimit
+	idempotency    IdempotencyStore
+	idempotencyTTL time.Duration
+	statusStore    StatusStore
+	generateID     func() string
+}
+
+type SMSOptFun func(option *SMSOption)
+
+// WithMaxSegments 最多拆分成几条短信，默认 1 条
+func WithMaxSegments(n int) SMSOptFun {
+	return func(option *SMSOption) {
+		option.maxSegments = n
+	}
+}
+
+// WithGateway 替换运营商接口，默认只打印日志
+func WithGateway(gateway Gateway) SMSOptFun {
+	return func(option *SMSOption) {
+		option.gateway = gateway
+	}
 }
 
 // 短信基类
+// 发送流程由 smsSkeleton 定义，各个通道只需要实现 send 步骤
 type sms struct {
-	ISMS
+	pipeline *Pipeline[*sendRequest]
+	option   SMSOption
+}
+
+// sendRequest 一次发送的上下文，在流水线的各个步骤之间传递
+type sendRequest struct {
+	sms     *sms
+	content string
+	phone   string
+	option  SendOption
+	parsed  Phone
+	id      string
+	// pendingID 占用幂等键时生成的消息 ID，记录状态之后才作为 id 返回
+	pendingID string
+	release   func()
 }
 
+// smsSkeleton 短信发送的算法骨架
+// 校验之后依次检查幂等键和限流，重复的发送不计入限流
+// 通过校验之后才会生成消息 ID，占用幂等键时绑定消息 ID，重复的发送返回第一次发送的消息 ID
+// 任何一步出错时释放幂等键，发送失败时记录失败原因
+var smsSkeleton = NewPipeline[*sendRequest](WithOnError(rollback)).
+	StepFunc("parse", func(ctx context.Context, req *sendRequest) error {
+		p, err := ParsePhone(req.phone)
+		req.parsed = p
+		return err
+	}).
+	StepFunc("valid", func(ctx context.Context, req *sendRequest) error {
+		return req.sms.Valid(req.content)
+	}).
+	StepFunc("reserve", func(ctx context.Context, req *sendRequest) error {
+		// 消息 ID 在占用幂等键时生成，重复的发送可以返回第一次发送的消息 ID
+		id, release, err := req.sms.reserve(req.option.idempotencyKey, req.sms.option.generateID())
+		if errors.Is(err, ErrDuplicate) {
+			req.id = id
+		}
+		req.pendingID = id
+		req.release = release
+		return err
+	}).
+	StepFunc("limit", func(ctx context.Context, req *sendRequest) error {
+		return req.sms.allow(req.parsed, req.option.template)
+	}).
+	StepFunc("record", func(ctx context.Context, req *sendRequest) error {
+		id := req.pendingID
+		if store := req.sms.option.statusStore; store != nil {
+			record := Record{ID: id, Phone: req.parsed.String(), Content: req.content, Template: req.option.template, Status: StatusQueued}
+			if err := store.Create(record); err != nil {
+				return err
+			}
+		}
+		req.id = id
+		return nil
+	}).
+	Abstract("send").
+	StepFunc("track", func(ctx context.Context, req *sendRequest) error {
+		// 短信已经发出，状态更新失败不影响结果，避免调用方重试导致重复发送
+		req.sms.track(req.id, func(record *Record) { record.Status = StatusSent })
+		return nil
+	})
+
+func rollback(ctx context.Context, step string, req *sendRequest, err error) error {
+	if req.release != nil {
+		req.release()
+	}
+	if step == "send" {
+		req.sms.track(req.id, func(record *Record) {
+			record.Status = StatusFailed
+			record.Error = err.Error()
+		})
+	}
+	return err
+}
+
+func newSMS(impl ISMS, opts ...SMSOptFun) *sms {
+	option := SMSOption{maxSegments: 1, generateID: randomID}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	// 通道以接口的形式实现 send 步骤
+	pipeline, err := smsSkeleton.Override("send", StepFunc[*sendRequest](func(ctx context.Context, req *sendRequest) error {
+		return impl.send(req.id, req.content, req.parsed)
+	}))
+	if err != nil {
+		panic(err)
+	}
+	return &sms{pipeline: pipeline, option: option}
+}
+
+// Valid 按照编码计算短信条数，超过限制时返回 ErrContentTooLong
 func (s sms) Valid(content string) error {
-	if len(content)>63{
-		return errors.New("短信超长")
+	encoding, segments := Segments(content)
+	if segments > s.option.maxSegments {
+		return fmt.Errorf("%w: %s 编码需要 %d 条，最多 %d 条", ErrContentTooLong, encoding, segments, s.option.maxSegments)
 	}
 	return nil
 }
 
-func (s *sms)Send(content string, phone int) error {
-	if err:=s.Valid(content); err != nil {
-		return err
+// Send 模板方法，phone 为 E.164 格式，返回消息 ID，发送失败时同时返回消息 ID 和错误
+func (s *sms)Send(content string, phone string, opts ...SendOptFun) (string, error) {
+	req := &sendRequest{sms: s, content: content, phone: phone}
+	for _, opt := range opts {
+		opt(&req.option)
+	}
+	err := s.pipeline.Run(context.Background(), req)
+	return req.id, err
+}
+
+// Carrier 短信通道
+type Carrier interface {
+	ISMS
+	Name() string
+	Valid(content string) error
+	// Supports 是否可以发送到该号码
+	Supports(phone Phone) bool
+}
+
+// carrier 国内运营商通道的公共部分，运营商之间互联互通，可以发送到所有国内手机号
+type carrier struct {
+	name    string
+	gateway Gateway
+}
+
+func newCarrier(name string, option SMSOption) *carrier {
+	c := &carrier{name: name, gateway: option.gateway}
+	if c.gateway == nil {
+		c.gateway = func(id, content string, phone Phone) error {
+			fmt.Printf("send by %s success\n", name)
+			return nil
+		}
 	}
+	return c
+}
+
+func (c *carrier) Name() string {
+	return c.name
+}
 
-	return s.send(content,phone)
+func (c *carrier) Supports(phone Phone) bool {
+	return phone.CountryCode == "86"
+}
+
+func (c *carrier) send(id, content string, phone Phone) error {
+	return c.gateway(id, content, phone)
+}
+
+// 国内运营商号段
+var carrierPrefixes = map[string][]string{
+	"telecom": {"133", "149", "153", "173", "177", "180", "181", "189", "190", "191", "193", "199"},
+	"mobile":  {"134", "135", "136", "137", "138", "139", "147", "150", "151", "152", "157", "158", "159", "172", "178", "182", "183", "184", "187", "188", "195", "197", "198"},
+	"unicom":  {"130", "131", "132", "145", "155", "156", "166", "167", "171", "175", "176", "185", "186", "196"},
+}
+
+// ChinaCarrier 国内手机号所属的运营商，未知时返回空字符串
+func ChinaCarrier(phone Phone) string {
+	if phone.CountryCode != "86" {
+		return ""
+	}
+	for name, prefixes := range carrierPrefixes {
+		if hasAnyPrefix(phone.Number, prefixes) {
+			return name
+		}
+	}
+	return ""
 }
 
 // TelecomSMS 走电信通道
 type TelecomSMS struct {
 	*sms
+	*carrier
 }
 
-func NewTelecomSMS() *TelecomSMS  {
+func NewTelecomSMS(opts ...SMSOptFun) *TelecomSMS  {
 	 tel := &TelecomSMS{}
-	// 这里有点绕，是因为 go 没有继承，用嵌套结构体的方法进行模拟
-	// 这里将子类作为接口嵌入父类，就可以让父类的模板方法 Send 调用到子类的函数
-	// 实际使用中，我们并不会这么写，都是采用组合+接口的方式完成类似的功能
-	 tel.sms = &sms{ISMS:tel}
+	// go 没有继承，这里不再把子类作为接口嵌入父类来模拟，而是用组合的方式：
+	// 父类的模板方法 Send 运行 smsSkeleton 流水线，子类作为接口实现其中的 send 步骤
+	 tel.sms = newSMS(tel, opts...)
+	 tel.carrier = newCarrier("telecom", tel.sms.option)
 	 return tel
 }
 
-func (tel *TelecomSMS) send(content string, phone int) error{
-	fmt.Println("send by telecom success")
-	return nil
+// MobileSMS 走移动通道
+type MobileSMS struct {
+	*sms
+	*carrier
+}
+
+func NewMobileSMS(opts ...SMSOptFun) *MobileSMS {
+	mobile := &MobileSMS{}
+	mobile.sms = newSMS(mobile, opts...)
+	mobile.carrier = newCarrier("mobile", mobile.sms.option)
+	return mobile
+}
+
+// UnicomSMS 走联通通道
+type UnicomSMS struct {
+	*sms
+	*carrier
 }
 
+func NewUnicomSMS(opts ...SMSOptFun) *UnicomSMS {
+	unicom := &UnicomSMS{}
+	unicom.sms = newSMS(unicom, opts...)
+	unicom.carrier = newCarrier("unicom", unicom.sms.option)
+	return unicom
+}
+
+func TestTelecomSMS(t *testing.T) {
+	var sent []string
+	tel := NewTelecomSMS(WithMaxSegments(2), WithGateway(func(id, content string, phone Phone) error {
+		sent = append(sent, phone.String()+" "+content)
+		return nil
+	}))
+
+	_, err := tel.Send("您的验证码是 1234", "+8613312345678")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"+8613312345678 您的验证码是 1234"}, sent)
+
+	_, err = tel.Send("验证码", "13312345678")
+	assert.True(t, errors.Is(err, ErrInvalidPhone))
+	_, err = tel.Send(strings.Repeat("验", 134), "+8613312345678")
+	require.NoError(t, err)
+	_, err = tel.Send(strings.Repeat("验", 135), "+8613312345678")
+	assert.True(t, errors.Is(err, ErrContentTooLong))
+	assert.Len(t, sent, 2)
+
+	assert.Equal(t, []string{"parse", "valid", "reserve", "limit", "record", "send", "track"}, tel.pipeline.Steps())
+
+	assert.Equal(t, "telecom", ChinaCarrier(Phone{CountryCode: "86", Number: "13312345678"}))
+	assert.Equal(t, "mobile", ChinaCarrier(Phone{CountryCode: "86", Number: "13912345678"}))
+	assert.Equal(t, "unicom", ChinaCarrier(Phone{CountryCode: "86", Number: "18612345678"}))
+	assert.Equal(t, "", ChinaCarrier(Phone{CountryCode: "1", Number: "4155552671"}))
+}
@@ -0,0 +1,426 @@
+package visitor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/foxmesh/gof-go/behavior/interpreter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 例子：告警规则的语法树
+// 优化器、格式化等工具需要遍历 interpreter.IExpression，节点类型的判断集中在这个文件中
+// Walk 按前序和后序回调遍历，Dispatch 按节点类型调用 ExpressionVisitor，Rewrite 自底向上替换节点
+
+var (
+	// SkipChildren 前序回调返回时不访问子节点，不会作为错误返回
+	SkipChildren = errors.New("skip children")
+	// ErrUnknownExpression Dispatch 不认识的节点类型
+	ErrUnknownExpression = errors.New("unknown expression")
+)
+
+// WalkFunc 遍历的回调，depth 是节点的深度，根节点是 0
+type WalkFunc func(e interpreter.IExpression, depth int) error
+
+// Walk 深度优先遍历，访问子节点之前调用 pre，之后调用 post，两者都可以为 nil
+// 回调返回 SkipChildren 以外的错误时停止遍历并返回这个错误
+func Walk(e interpreter.IExpression, pre, post WalkFunc) error {
+	return walk(e, 0, pre, post)
+}
+
+func walk(e interpreter.IExpression, depth int, pre, post WalkFunc) error {
+	skip := false
+	if pre != nil {
+		if err := pre(e, depth); errors.Is(err, SkipChildren) {
+			skip = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if !skip {
+		for _, child := range children(e) {
+			if err := walk(child, depth+1, pre, post); err != nil {
+				return err
+			}
+		}
+	}
+	if post != nil {
+		if err := post(e, depth); err != nil && !errors.Is(err, SkipChildren) {
+			return err
+		}
+	}
+	return nil
+}
+
+// children 只有 && 节点有子节点
+func children(e interpreter.IExpression) []interpreter.IExpression {
+	if and, ok := asAnd(e); ok {
+		return and.Expressions()
+	}
+	return nil
+}
+
+// asAnd 方法的接收者有值也有指针，统一转换成指针
+func asAnd(e interpreter.IExpression) (*interpreter.AndExpression, bool) {
+	switch e := e.(type) {
+	case *interpreter.AndExpression:
+		return e, true
+	case interpreter.AndExpression:
+		return &e, true
+	}
+	return nil, false
+}
+
+// ExpressionVisitor 按节点类型访问，是否访问 && 的子节点由访问者决定
+type ExpressionVisitor interface {
+	VisitGreater(e *interpreter.GreaterExpression) error
+	VisitLess(e *interpreter.LessExpression) error
+	VisitAnd(e *interpreter.AndExpression) error
+	VisitConst(e *interpreter.ConstExpression) error
+}
+
+// Dispatch 调用访问者中与节点类型对应的方法
+func Dispatch(e interpreter.IExpression, v ExpressionVisitor) error {
+	switch e := e.(type) {
+	case *interpreter.GreaterExpression:
+		return v.VisitGreater(e)
+	case *interpreter.LessExpression:
+		return v.VisitLess(e)
+	case interpreter.LessExpression:
+		return v.VisitLess(&e)
+	case *interpreter.AndExpression:
+		return v.VisitAnd(e)
+	case interpreter.AndExpression:
+		return v.VisitAnd(&e)
+	case *interpreter.ConstExpression:
+		return v.VisitConst(e)
+	case interpreter.ConstExpression:
+		return v.VisitConst(&e)
+	}
+	return fmt.Errorf("%w: %T", ErrUnknownExpression, e)
+}
+
+// Printer 把语法树格式化成规则字符串，结果可以再用 interpreter.NewAlertRule 解析
+type Printer struct {
+	b strings.Builder
+}
+
+func (p *Printer) VisitGreater(e *interpreter.GreaterExpression) error {
+	p.b.WriteString(e.Key() + " > " + strconv.FormatFloat(e.Value(), 'g', -1, 64))
+	return nil
+}
+
+func (p *Printer) VisitLess(e *interpreter.LessExpression) error {
+	p.b.WriteString(e.Key() + " < " + strconv.FormatFloat(e.Value(), 'g', -1, 64))
+	return nil
+}
+
+func (p *Printer) VisitAnd(e *interpreter.AndExpression) error {
+	for i, sub := range e.Expressions() {
+		if i > 0 {
+			p.b.WriteString(" && ")
+		}
+		if err := Dispatch(sub, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Printer) VisitConst(e *interpreter.ConstExpression) error {
+	p.b.WriteString(strconv.FormatBool(e.Value()))
+	return nil
+}
+
+func (p *Printer) String() string {
+	return p.b.String()
+}
+
+// Format 格式化语法树
+func Format(e interpreter.IExpression) (string, error) {
+	p := &Printer{}
+	if err := Dispatch(e, p); err != nil {
+		return "", err
+	}
+	return p.String(), nil
+}
+
+// RewriteFunc 返回替换后的节点，不需要替换时返回原节点
+type RewriteFunc func(e interpreter.IExpression) (interpreter.IExpression, error)
+
+// Rewrite 后序遍历，先改写子节点，再用改写后的子节点重新构造 && 节点交给 fn
+// 不修改原来的语法树
+func Rewrite(e interpreter.IExpression, fn RewriteFunc) (interpreter.IExpression, error) {
+	if and, ok := asAnd(e); ok {
+		subs := and.Expressions()
+		for i, sub := range subs {
+			rewritten, err := Rewrite(sub, fn)
+			if err != nil {
+				return nil, err
+			}
+			subs[i] = rewritten
+		}
+		e = interpreter.And(subs...)
+	}
+	return fn(e)
+}
+
+// Fold 常量折叠：展开嵌套的 &&，去掉 true，同一个指标的多个 > 或 < 只保留最严格的一个
+// 出现 false 或者同一个指标的范围为空时，整个表达式折叠为 false
+func Fold(e interpreter.IExpression) (interpreter.IExpression, error) {
+	return Rewrite(e, fold)
+}
+
+func fold(e interpreter.IExpression) (interpreter.IExpression, error) {
+	and, ok := asAnd(e)
+	if !ok {
+		return e, nil
+	}
+
+	f := &folder{lower: map[string]float64{}, upper: map[string]float64{}}
+	if err := f.VisitAnd(and); err != nil {
+		return nil, err
+	}
+	if f.never {
+		return interpreter.Const(false), nil
+	}
+
+	var folded []interpreter.IExpression
+	for _, key := range f.keys {
+		l, hasLower := f.lower[key]
+		u, hasUpper := f.upper[key]
+		if hasLower && hasUpper && l >= u {
+			return interpreter.Const(false), nil
+		}
+		if hasLower {
+			folded = append(folded, interpreter.Greater(key, l))
+		}
+		if hasUpper {
+			folded = append(folded, interpreter.Less(key, u))
+		}
+	}
+	folded = append(folded, f.others...)
+	switch len(folded) {
+	case 0:
+		return interpreter.Const(true), nil
+	case 1:
+		return folded[0], nil
+	}
+	return interpreter.And(folded...), nil
+}
+
+// folder 展开嵌套的 &&，收集每个指标最严格的上下界
+// 通过 Dispatch 访问子节点，值和指针两种形式的节点按同样的规则折叠
+type folder struct {
+	// keys 按第一次出现的顺序输出
+	keys   []string
+	lower  map[string]float64
+	upper  map[string]float64
+	others []interpreter.IExpression
+	// never 出现了 false
+	never bool
+}
+
+func (f *folder) VisitGreater(e *interpreter.GreaterExpression) error {
+	f.seen(e.Key())
+	if v, ok := f.lower[e.Key()]; !ok || e.Value() > v {
+		f.lower[e.Key()] = e.Value()
+	}
+	return nil
+}
+
+func (f *folder) VisitLess(e *interpreter.LessExpression) error {
+	f.seen(e.Key())
+	if v, ok := f.upper[e.Key()]; !ok || e.Value() < v {
+		f.upper[e.Key()] = e.Value()
+	}
+	return nil
+}
+
+func (f *folder) VisitAnd(e *interpreter.AndExpression) error {
+	for _, sub := range e.Expressions() {
+		err := Dispatch(sub, f)
+		// 不认识的节点原样保留
+		if errors.Is(err, ErrUnknownExpression) {
+			f.others = append(f.others, sub)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *folder) VisitConst(e *interpreter.ConstExpression) error {
+	if !e.Value() {
+		f.never = true
+	}
+	return nil
+}
+
+func (f *folder) seen(key string) {
+	_, l := f.lower[key]
+	_, u := f.upper[key]
+	if !l && !u {
+		f.keys = append(f.keys, key)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	rule, err := interpreter.NewAlertRule("a > 1 && b < 2")
+	require.NoError(t, err)
+	tree := interpreter.And(rule.Expression(), interpreter.Less("c", 3))
+
+	var events []string
+	name := func(e interpreter.IExpression) string {
+		if _, ok := asAnd(e); ok {
+			return "&&"
+		}
+		s, err := Format(e)
+		require.NoError(t, err)
+		return s
+	}
+	err = Walk(tree, func(e interpreter.IExpression, depth int) error {
+		events = append(events, fmt.Sprintf("pre %d %s", depth, name(e)))
+		return nil
+	}, func(e interpreter.IExpression, depth int) error {
+		events = append(events, fmt.Sprintf("post %d %s", depth, name(e)))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"pre 0 &&", "pre 1 &&", "pre 2 a > 1", "post 2 a > 1", "pre 2 b < 2", "post 2 b < 2", "post 1 &&",
+		"pre 1 c < 3", "post 1 c < 3", "post 0 &&",
+	}, events)
+
+	// 跳过子节点，或者提前停止
+	var leaves []string
+	stop := errors.New("stop")
+	err = Walk(tree, func(e interpreter.IExpression, depth int) error {
+		if _, ok := asAnd(e); ok && depth > 0 {
+			return SkipChildren
+		}
+		if _, ok := asAnd(e); !ok {
+			leaves = append(leaves, name(e))
+			return stop
+		}
+		return nil
+	}, nil)
+	assert.True(t, errors.Is(err, stop))
+	assert.Equal(t, []string{"c < 3"}, leaves)
+
+	s, err := Format(interpreter.And(interpreter.LessExpression{}, interpreter.Const(true)))
+	require.NoError(t, err)
+	assert.Equal(t, " < 0 && true", s)
+	_, err = Format(rule)
+	assert.True(t, errors.Is(err, ErrUnknownExpression))
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		name string
+		exp  interpreter.IExpression
+		want string
+	}{
+		{
+			name: "merge bounds",
+			exp: interpreter.And(interpreter.Greater("a", 1), interpreter.Less("b", 10),
+				interpreter.And(interpreter.Greater("a", 3), interpreter.Less("b", 20))),
+			want: "a > 3 && b < 10",
+		},
+		{
+			name: "drop true",
+			exp:  interpreter.And(interpreter.Const(true), interpreter.And(interpreter.Greater("a", 1), interpreter.Const(true))),
+			want: "a > 1",
+		},
+		{
+			name: "false",
+			exp:  interpreter.And(interpreter.Greater("a", 1), interpreter.And(interpreter.Const(false))),
+			want: "false",
+		},
+		{
+			name: "empty range",
+			exp:  interpreter.And(interpreter.Greater("a", 5), interpreter.Less("b", 1), interpreter.Less("a", 5)),
+			want: "false",
+		},
+		{
+			name: "value nodes",
+			exp:  interpreter.And(*interpreter.Less("a", 5), interpreter.Less("a", 3), *interpreter.Const(true)),
+			want: "a < 3",
+		},
+		{
+			name: "value false",
+			exp:  interpreter.And(interpreter.Greater("a", 1), *interpreter.Const(false)),
+			want: "false",
+		},
+		{
+			name: "empty and",
+			exp:  interpreter.And(),
+			want: "true",
+		},
+	}
+	stats := []map[string]float64{{"a": 0, "b": 0}, {"a": 2, "b": 5}, {"a": 4, "b": 15}, {"a": 6, "b": 0}, {}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folded, err := Fold(tt.exp)
+			require.NoError(t, err)
+			s, err := Format(folded)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, s)
+			// 折叠前后的结果相同
+			for _, st := range stats {
+				assert.Equal(t, tt.exp.Interpret(st), folded.Interpret(st), st)
+			}
+		})
+	}
+
+	// 格式化的结果可以重新解析
+	rule, err := interpreter.NewAlertRule("a > 1 && b < 10 && a > 3")
+	require.NoError(t, err)
+	folded, err := Fold(rule.Expression())
+	require.NoError(t, err)
+	s, err := Format(folded)
+	require.NoError(t, err)
+	assert.Equal(t, "a > 3 && b < 10", s)
+	_, err = interpreter.NewAlertRule(s)
+	assert.NoError(t, err)
+
+	// 折叠出的常量同样可以重新解析
+	for _, exp := range []interpreter.IExpression{
+		interpreter.And(interpreter.Greater("a", 5), interpreter.Less("a", 1)),
+		interpreter.And(interpreter.Greater("a", 1), interpreter.Less("b", 10), interpreter.Greater("a", 3)),
+	} {
+		folded, err := Fold(exp)
+		require.NoError(t, err)
+		s, err := Format(folded)
+		require.NoError(t, err)
+		parsed, err := interpreter.NewAlertRule(s)
+		require.NoError(t, err, s)
+		for _, st := range []map[string]float64{{"a": 0, "b": 0}, {"a": 4, "b": 5}} {
+			assert.Equal(t, exp.Interpret(st), parsed.Interpret(st), s)
+		}
+	}
+	s, err = Format(interpreter.And(interpreter.Greater("a", 1), interpreter.Const(true)))
+	require.NoError(t, err)
+	assert.Equal(t, "a > 1 && true", s)
+	parsed, err := interpreter.NewAlertRule(s)
+	require.NoError(t, err)
+	assert.True(t, parsed.Interpret(map[string]float64{"a": 2}))
+	parsed, err = interpreter.NewAlertRule("false")
+	require.NoError(t, err)
+	assert.False(t, parsed.Interpret(nil))
+	_, err = interpreter.NewAlertRule("a > 1 && yes")
+	assert.Error(t, err)
+
+	// 改写失败时返回错误
+	failed := errors.New("failed")
+	_, err = Rewrite(rule.Expression(), func(e interpreter.IExpression) (interpreter.IExpression, error) {
+		return nil, failed
+	})
+	assert.True(t, errors.Is(err, failed))
+}
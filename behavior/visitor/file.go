@@ -0,0 +1,576 @@
+package visitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 例子：访问者模式最经典的例子，处理目录中不同类型的资源文件
+// 文本提取、压缩、建立索引对 PDF、Word、PPT 的处理方式各不相同，每种处理实现为一个访问者，文件类型本身保持不变
+// 文件的 Accept 调用访问者中与自己类型对应的方法，完成双分派
+// 新的文件类型通过 KindRegistry 注册，并定义自己的可选访问者接口，不支持这个类型的访问者不需要修改
+// WalkFiles 并发访问目录中的文件，访问者的方法会被并发调用，需要自己保证并发安全
+
+// ErrUnsupportedKind 访问者不支持这个文件类型，WalkFiles 会跳过这个文件
+var ErrUnsupportedKind = errors.New("unsupported file kind")
+
+// ResourceFile 资源文件
+type ResourceFile interface {
+	Path() string
+	Accept(v FileVisitor) error
+}
+
+// FileVisitor 内置文件类型的访问者
+type FileVisitor interface {
+	VisitPDF(f *PDFFile) error
+	VisitWord(f *WordFile) error
+	VisitPPT(f *PPTFile) error
+}
+
+type PDFFile struct {
+	path string
+}
+
+func (f *PDFFile) Path() string {
+	return f.path
+}
+
+func (f *PDFFile) Accept(v FileVisitor) error {
+	return v.VisitPDF(f)
+}
+
+type WordFile struct {
+	path string
+}
+
+func (f *WordFile) Path() string {
+	return f.path
+}
+
+func (f *WordFile) Accept(v FileVisitor) error {
+	return v.VisitWord(f)
+}
+
+type PPTFile struct {
+	path string
+}
+
+func (f *PPTFile) Path() string {
+	return f.path
+}
+
+func (f *PPTFile) Accept(v FileVisitor) error {
+	return v.VisitPPT(f)
+}
+
+// TextFile 通过注册表扩展的文件类型，只有实现了 TextVisitor 的访问者才能处理
+type TextFile struct {
+	path string
+}
+
+// TextVisitor TextFile 的访问者
+type TextVisitor interface {
+	VisitText(f *TextFile) error
+}
+
+func NewTextFile(path string) ResourceFile {
+	return &TextFile{path: path}
+}
+
+func (f *TextFile) Path() string {
+	return f.path
+}
+
+func (f *TextFile) Accept(v FileVisitor) error {
+	if tv, ok := v.(TextVisitor); ok {
+		return tv.VisitText(f)
+	}
+	return fmt.Errorf("%w: %T does not visit text", ErrUnsupportedKind, v)
+}
+
+// FileKind 文件类型
+type FileKind struct {
+	Name string
+	New  func(path string) ResourceFile
+}
+
+// KindRegistry 扩展名到文件类型的映射，并发安全
+type KindRegistry struct {
+	lock  sync.RWMutex
+	kinds map[string]FileKind
+}
+
+// NewKindRegistry 已经注册了 PDF、Word、PPT
+func NewKindRegistry() *KindRegistry {
+	r := &KindRegistry{kinds: map[string]FileKind{}}
+	r.Register(FileKind{Name: "pdf", New: func(path string) ResourceFile { return &PDFFile{path: path} }}, ".pdf")
+	r.Register(FileKind{Name: "word", New: func(path string) ResourceFile { return &WordFile{path: path} }}, ".doc", ".docx")
+	r.Register(FileKind{Name: "ppt", New: func(path string) ResourceFile { return &PPTFile{path: path} }}, ".ppt", ".pptx")
+	return r
+}
+
+// Register 注册文件类型，扩展名不区分大小写，已经注册的扩展名会被覆盖
+func (r *KindRegistry) Register(kind FileKind, exts ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, ext := range exts {
+		r.kinds[strings.ToLower(ext)] = kind
+	}
+}
+
+// Open 按扩展名创建文件，没有注册的扩展名返回 false
+func (r *KindRegistry) Open(path string) (ResourceFile, bool) {
+	r.lock.RLock()
+	kind, ok := r.kinds[strings.ToLower(filepath.Ext(path))]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return kind.New(path), true
+}
+
+// WalkOption WalkFiles 的可选参数
+type WalkOption struct {
+	workers int
+	kinds   *KindRegistry
+	// fsys 遍历目录使用的文件系统，默认为 os.DirFS(root)，测试时用来模拟读取目录失败
+	fsys fs.FS
+}
+
+type WalkOptFun func(option *WalkOption)
+
+// WithWorkers 同时访问的文件数量，默认为 CPU 数量
+func WithWorkers(n int) WalkOptFun {
+	return func(option *WalkOption) {
+		option.workers = n
+	}
+}
+
+// WithKinds 替换文件类型的注册表，默认为 NewKindRegistry
+func WithKinds(kinds *KindRegistry) WalkOptFun {
+	return func(option *WalkOption) {
+		option.kinds = kinds
+	}
+}
+
+// withFS 替换遍历目录使用的文件系统，访问者仍然从 root 下读取文件
+func withFS(fsys fs.FS) WalkOptFun {
+	return func(option *WalkOption) {
+		option.fsys = fsys
+	}
+}
+
+// WalkFiles 遍历 root 下所有注册过的文件，交给 v 访问
+// 单个文件或目录失败不影响其他文件，所有的错误合并后返回；只有 ctx 取消时停止遍历
+func WalkFiles(ctx context.Context, root string, v FileVisitor, opts ...WalkOptFun) error {
+	option := WalkOption{workers: runtime.NumCPU()}
+	for _, opt := range opts {
+		opt(&option)
+	}
+	option.workers = max(option.workers, 1)
+	if option.kinds == nil {
+		option.kinds = NewKindRegistry()
+	}
+	if option.fsys == nil {
+		option.fsys = os.DirFS(root)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		errs  []error
+		files = make(chan ResourceFile)
+	)
+	for i := 0; i < option.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				// 取消之前已经发出的文件不再访问
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := f.Accept(v); err != nil && !errors.Is(err, ErrUnsupportedKind) {
+					lock.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", f.Path(), err))
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	err := fs.WalkDir(option.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// 无法读取的目录跳过，记录错误后继续遍历其他目录
+		if err != nil {
+			lock.Lock()
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			lock.Unlock()
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, ok := option.kinds.Open(path)
+		if !ok {
+			return nil
+		}
+		select {
+		case files <- f:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(files)
+	wg.Wait()
+	return errors.Join(append([]error{err}, errs...)...)
+}
+
+// textOf 按文件类型提取文本，Extractor 和 Indexer 共用
+// 例子中 PDF 直接保存文本，Word 每行一个段落，PPT 用换页符分隔幻灯片
+type textOf struct {
+	text string
+}
+
+func (t *textOf) VisitPDF(f *PDFFile) error {
+	data, err := os.ReadFile(f.Path())
+	t.text = strings.TrimSpace(string(data))
+	return err
+}
+
+func (t *textOf) VisitWord(f *WordFile) error {
+	data, err := os.ReadFile(f.Path())
+	var paragraphs []string
+	for _, p := range strings.Split(string(data), "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+	t.text = strings.Join(paragraphs, "\n")
+	return err
+}
+
+func (t *textOf) VisitPPT(f *PPTFile) error {
+	data, err := os.ReadFile(f.Path())
+	slides := strings.Split(strings.TrimSpace(string(data)), "\f")
+	for i := range slides {
+		slides[i] = strings.TrimSpace(slides[i])
+	}
+	t.text = strings.Join(slides, "\n")
+	return err
+}
+
+func (t *textOf) VisitText(f *TextFile) error {
+	data, err := os.ReadFile(f.Path())
+	t.text = string(data)
+	return err
+}
+
+func extractText(f ResourceFile) (string, error) {
+	t := &textOf{}
+	err := f.Accept(t)
+	return t.text, err
+}
+
+// Extractor 提取文本
+type Extractor struct {
+	lock  sync.Mutex
+	texts map[string]string
+}
+
+func NewExtractor() *Extractor {
+	return &Extractor{texts: map[string]string{}}
+}
+
+func (e *Extractor) VisitPDF(f *PDFFile) error   { return e.extract(f) }
+func (e *Extractor) VisitWord(f *WordFile) error { return e.extract(f) }
+func (e *Extractor) VisitPPT(f *PPTFile) error   { return e.extract(f) }
+func (e *Extractor) VisitText(f *TextFile) error { return e.extract(f) }
+
+func (e *Extractor) extract(f ResourceFile) error {
+	text, err := extractText(f)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.texts[f.Path()] = text
+	return nil
+}
+
+// Text 文件提取出的文本
+func (e *Extractor) Text(path string) (string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	text, ok := e.texts[path]
+	return text, ok
+}
+
+// Compressor 计算压缩后的大小，PDF 本身已经压缩过，原样保存
+type Compressor struct {
+	lock  sync.Mutex
+	sizes map[string]int
+}
+
+func NewCompressor() *Compressor {
+	return &Compressor{sizes: map[string]int{}}
+}
+
+func (c *Compressor) VisitPDF(f *PDFFile) error {
+	data, err := os.ReadFile(f.Path())
+	if err != nil {
+		return err
+	}
+	c.record(f.Path(), len(data))
+	return nil
+}
+
+func (c *Compressor) VisitWord(f *WordFile) error {
+	return c.gzip(f.Path())
+}
+
+func (c *Compressor) VisitPPT(f *PPTFile) error {
+	return c.gzip(f.Path())
+}
+
+func (c *Compressor) gzip(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.record(path, buf.Len())
+	return nil
+}
+
+func (c *Compressor) record(path string, size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sizes[path] = size
+}
+
+// Size 文件压缩后的大小
+func (c *Compressor) Size(path string) (int, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	size, ok := c.sizes[path]
+	return size, ok
+}
+
+// Indexer 建立单词到文件的倒排索引，单词不区分大小写
+type Indexer struct {
+	lock  sync.Mutex
+	index map[string]map[string]bool
+}
+
+func NewIndexer() *Indexer {
+	return &Indexer{index: map[string]map[string]bool{}}
+}
+
+func (x *Indexer) VisitPDF(f *PDFFile) error   { return x.add(f) }
+func (x *Indexer) VisitWord(f *WordFile) error { return x.add(f) }
+func (x *Indexer) VisitPPT(f *PPTFile) error   { return x.add(f) }
+func (x *Indexer) VisitText(f *TextFile) error { return x.add(f) }
+
+func (x *Indexer) add(f ResourceFile) error {
+	text, err := extractText(f)
+	if err != nil {
+		return err
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if x.index[word] == nil {
+			x.index[word] = map[string]bool{}
+		}
+		x.index[word][f.Path()] = true
+	}
+	return nil
+}
+
+// Search 包含单词的文件，按路径排序
+func (x *Indexer) Search(word string) []string {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	var paths []string
+	for path := range x.index[strings.ToLower(word)] {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// limitVisitor 记录同时访问的最大文件数量，cancel 不为空时在第一次访问时调用
+type limitVisitor struct {
+	active  atomic.Int32
+	maximum atomic.Int32
+	visited atomic.Int32
+	cancel  context.CancelFunc
+}
+
+func (l *limitVisitor) visit() error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	n := l.active.Add(1)
+	defer l.active.Add(-1)
+	for {
+		m := l.maximum.Load()
+		if n <= m || l.maximum.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	l.visited.Add(1)
+	return nil
+}
+
+func (l *limitVisitor) VisitPDF(f *PDFFile) error   { return l.visit() }
+func (l *limitVisitor) VisitWord(f *WordFile) error { return l.visit() }
+func (l *limitVisitor) VisitPPT(f *PPTFile) error   { return l.visit() }
+
+func TestWalkFiles(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"report.pdf":        "Quarterly report\n",
+		"docs/design.DOCX":  "  Visitor design  \n\nDouble dispatch\n",
+		"docs/slides.pptx":  "Intro\fVisitor pattern\fQ&A",
+		"docs/notes.txt":    "visitor notes",
+		"docs/image.png":    "not a document",
+		"archive/old.doc":   strings.Repeat("old old old ", 100),
+		"archive/empty.ppt": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+	path := func(name string) string {
+		return filepath.Join(root, name)
+	}
+	kinds := NewKindRegistry()
+	kinds.Register(FileKind{Name: "text", New: NewTextFile}, ".txt")
+
+	extractor := NewExtractor()
+	require.NoError(t, WalkFiles(context.Background(), root, extractor, WithKinds(kinds)))
+	text, ok := extractor.Text(path("docs/design.DOCX"))
+	assert.True(t, ok)
+	assert.Equal(t, "Visitor design\nDouble dispatch", text)
+	text, _ = extractor.Text(path("docs/slides.pptx"))
+	assert.Equal(t, "Intro\nVisitor pattern\nQ&A", text)
+	text, _ = extractor.Text(path("docs/notes.txt"))
+	assert.Equal(t, "visitor notes", text)
+	_, ok = extractor.Text(path("docs/image.png"))
+	assert.False(t, ok)
+
+	// Compressor 不支持 TextFile，跳过而不是报错
+	compressor := NewCompressor()
+	require.NoError(t, WalkFiles(context.Background(), root, compressor, WithKinds(kinds)))
+	size, _ := compressor.Size(path("report.pdf"))
+	assert.Equal(t, len(files["report.pdf"]), size)
+	size, _ = compressor.Size(path("archive/old.doc"))
+	assert.Less(t, size, len(files["archive/old.doc"]))
+	_, ok = compressor.Size(path("docs/notes.txt"))
+	assert.False(t, ok)
+
+	indexer := NewIndexer()
+	require.NoError(t, WalkFiles(context.Background(), root, indexer, WithKinds(kinds), WithWorkers(2)))
+	assert.Equal(t, []string{path("docs/design.DOCX"), path("docs/notes.txt"), path("docs/slides.pptx")}, indexer.Search("Visitor"))
+	assert.Nil(t, indexer.Search("missing"))
+
+	// 默认注册表不认识 .txt
+	indexer = NewIndexer()
+	require.NoError(t, WalkFiles(context.Background(), root, indexer))
+	assert.Equal(t, []string{path("docs/design.DOCX"), path("docs/slides.pptx")}, indexer.Search("visitor"))
+
+	// 单个文件失败不影响其他文件
+	require.NoError(t, os.Symlink(path("missing.pdf"), path("broken.pdf")))
+	extractor = NewExtractor()
+	err := WalkFiles(context.Background(), root, extractor)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.ErrorContains(t, err, "broken.pdf")
+	_, ok = extractor.Text(path("docs/slides.pptx"))
+	assert.True(t, ok)
+
+	// 无法读取的目录不影响其他目录
+	require.NoError(t, os.Remove(path("broken.pdf")))
+	extractor = NewExtractor()
+	err = WalkFiles(context.Background(), root, extractor, withFS(failingFS{FS: os.DirFS(root), dir: "archive"}))
+	assert.True(t, errors.Is(err, fs.ErrPermission))
+	assert.ErrorContains(t, err, path("archive"))
+	_, ok = extractor.Text(path("report.pdf"))
+	assert.True(t, ok)
+	_, ok = extractor.Text(path("docs/slides.pptx"))
+	assert.True(t, ok)
+	_, ok = extractor.Text(path("archive/old.doc"))
+	assert.False(t, ok)
+}
+
+// failingFS 读取 dir 目录时失败，模拟没有权限的目录
+type failingFS struct {
+	fs.FS
+	dir string
+}
+
+func (f failingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == f.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	return fs.ReadDir(f.FS, name)
+}
+
+func TestWalkFiles_Concurrent(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 30; i++ {
+		ext := []string{".pdf", ".docx", ".pptx"}[i%3]
+		require.NoError(t, os.WriteFile(filepath.Join(root, fmt.Sprintf("file%02d%s", i, ext)), nil, 0o644))
+	}
+
+	v := &limitVisitor{}
+	require.NoError(t, WalkFiles(context.Background(), root, v, WithWorkers(3)))
+	assert.Equal(t, int32(30), v.visited.Load())
+	assert.LessOrEqual(t, v.maximum.Load(), int32(3))
+	assert.Greater(t, v.maximum.Load(), int32(1))
+
+	// 取消之后不再访问新的文件
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v = &limitVisitor{}
+	err := WalkFiles(ctx, root, v, WithWorkers(1))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, int32(0), v.visited.Load())
+
+	// 访问过程中取消，正在访问的文件完成后不再访问新的文件
+	ctx, cancel = context.WithCancel(context.Background())
+	v = &limitVisitor{cancel: cancel}
+	err = WalkFiles(ctx, root, v, WithWorkers(1))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, int32(1), v.visited.Load())
+}
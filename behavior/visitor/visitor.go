@@ -1 +1,191 @@
+// Package visitor 访问者模式
+// 定义：允许一个或者多个操作应用到一组对象上，解耦操作和对象本身
+// 访问者模式针对的是一组类型不同的对象，这些对象的类型相对稳定，但是需要对它们执行的操作经常变化
+// 为了避免不断给这些类添加功能导致类不断膨胀、职责越来越不单一，把操作从对象中拆分出来，放到独立的访问者中
+// 双分派：Go 只支持单分派，调用哪个方法只由接收者的运行时类型决定
+// 对象的 Accept 方法再调用访问者中与自己类型对应的 VisitXxx 方法，由对象和访问者两者的类型决定最终执行的代码
+// 副作用：增加新的对象类型时，所有的访问者都要修改
 package visitor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/foxmesh/gof-go/structure/composite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 例子：组织架构的统计和导出
+// composite.IOrganization 只支持 Count，新的功能都实现为 composite.IVisitor，不需要修改 Employee 和 Department
+
+// Headcount 统计员工和部门的数量
+type Headcount struct {
+	Employees   int
+	Departments int
+}
+
+func (h *Headcount) VisitEmployee(e composite.Employee) {
+	h.Employees++
+}
+
+func (h *Headcount) VisitDepartment(d composite.Department) {
+	h.Departments++
+	for _, sub := range d.SubOrganizations {
+		sub.Accept(h)
+	}
+}
+
+// SalaryTotal 统计工资总额，以及每个部门（包括下级部门）的工资总额
+type SalaryTotal struct {
+	Total int
+	// ByDepartment key 是从根部门开始用 / 连接的部门名称，部门可能重名
+	ByDepartment map[string]int
+	path         []string
+}
+
+func NewSalaryTotal() *SalaryTotal {
+	return &SalaryTotal{ByDepartment: map[string]int{}}
+}
+
+func (s *SalaryTotal) VisitEmployee(e composite.Employee) {
+	s.Total += e.Salary
+	// 员工的工资计入所有上级部门
+	for i := range s.path {
+		s.ByDepartment[strings.Join(s.path[:i+1], "/")] += e.Salary
+	}
+}
+
+func (s *SalaryTotal) VisitDepartment(d composite.Department) {
+	s.path = append(s.path, d.Name)
+	// 没有员工的部门也要出现在结果中
+	s.ByDepartment[strings.Join(s.path, "/")] += 0
+	for _, sub := range d.SubOrganizations {
+		sub.Accept(s)
+	}
+	s.path = s.path[:len(s.path)-1]
+}
+
+// Depth 组织架构的最大层数，被访问的节点是第 1 层
+type Depth struct {
+	Max     int
+	current int
+}
+
+func (d *Depth) VisitEmployee(e composite.Employee) {
+	d.Max = max(d.Max, d.current+1)
+}
+
+func (d *Depth) VisitDepartment(dept composite.Department) {
+	d.current++
+	d.Max = max(d.Max, d.current)
+	for _, sub := range dept.SubOrganizations {
+		sub.Accept(d)
+	}
+	d.current--
+}
+
+// Node 导出的组织架构节点
+type Node struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Salary   int    `json:"salary,omitempty"`
+	Children []Node `json:"children,omitempty"`
+}
+
+const (
+	KindEmployee   = "employee"
+	KindDepartment = "department"
+)
+
+// Exporter 把组织架构导出为 Node 树，可以再编码为 JSON 等格式
+type Exporter struct {
+	// Root 导出的结果
+	Root  Node
+	stack []*Node
+}
+
+func (x *Exporter) VisitEmployee(e composite.Employee) {
+	x.add(Node{Kind: KindEmployee, Name: e.Name, Salary: e.Salary})
+}
+
+func (x *Exporter) VisitDepartment(d composite.Department) {
+	node := x.add(Node{Kind: KindDepartment, Name: d.Name})
+	x.stack = append(x.stack, node)
+	for _, sub := range d.SubOrganizations {
+		sub.Accept(x)
+	}
+	x.stack = x.stack[:len(x.stack)-1]
+}
+
+// add 把节点加到当前部门下，没有当前部门时作为根节点
+func (x *Exporter) add(n Node) *Node {
+	if len(x.stack) == 0 {
+		x.Root = n
+		return &x.Root
+	}
+	parent := x.stack[len(x.stack)-1]
+	parent.Children = append(parent.Children, n)
+	return &parent.Children[len(parent.Children)-1]
+}
+
+// Export 导出组织架构
+func Export(org composite.IOrganization) Node {
+	x := &Exporter{}
+	org.Accept(x)
+	return x.Root
+}
+
+func newCompany() composite.IOrganization {
+	return &composite.Department{Name: "company", SubOrganizations: []composite.IOrganization{
+		composite.Employee{Name: "ceo", Salary: 50000},
+		&composite.Department{Name: "rd", SubOrganizations: []composite.IOrganization{
+			composite.Employee{Name: "alice", Salary: 30000},
+			&composite.Department{Name: "infra", SubOrganizations: []composite.IOrganization{
+				composite.Employee{Name: "bob", Salary: 20000},
+			}},
+		}},
+		&composite.Department{Name: "hr"},
+	}}
+}
+
+func TestOrganizationVisitor(t *testing.T) {
+	org := newCompany()
+
+	headcount := &Headcount{}
+	org.Accept(headcount)
+	assert.Equal(t, Headcount{Employees: 3, Departments: 4}, *headcount)
+	assert.Equal(t, org.Count(), headcount.Employees)
+
+	salary := NewSalaryTotal()
+	org.Accept(salary)
+	assert.Equal(t, 100000, salary.Total)
+	assert.Equal(t, map[string]int{
+		"company":          100000,
+		"company/rd":       50000,
+		"company/rd/infra": 20000,
+		"company/hr":       0,
+	}, salary.ByDepartment)
+
+	depth := &Depth{}
+	org.Accept(depth)
+	assert.Equal(t, 4, depth.Max)
+	depth = &Depth{}
+	composite.NewOrganization().Accept(depth)
+	assert.Equal(t, 3, depth.Max)
+	depth = &Depth{}
+	composite.Employee{}.Accept(depth)
+	assert.Equal(t, 1, depth.Max)
+
+	data, err := json.Marshal(Export(org))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"kind":"department","name":"company","children":[
+		{"kind":"employee","name":"ceo","salary":50000},
+		{"kind":"department","name":"rd","children":[
+			{"kind":"employee","name":"alice","salary":30000},
+			{"kind":"department","name":"infra","children":[{"kind":"employee","name":"bob","salary":20000}]}
+		]},
+		{"kind":"department","name":"hr"}
+	]}`, string(data))
+}
@@ -16,16 +16,30 @@ import (
 
 type IOrganization interface {
 	Count() int
+	// Accept 接受访问者，新增的统计和导出功能都实现为访问者，不需要修改 Employee 和 Department
+	Accept(v IVisitor)
+}
+
+// IVisitor 访问者，由访问者决定是否继续访问部门的下级
+type IVisitor interface {
+	VisitEmployee(e Employee)
+	VisitDepartment(d Department)
 }
 
 type Employee struct {
 	Name string
+	// Salary 月薪，单位元
+	Salary int
 }
 
 func (e Employee) Count() int {
 	return 1
 }
 
+func (e Employee) Accept(v IVisitor) {
+	v.VisitEmployee(e)
+}
+
 type Department struct {
 	Name             string
 	SubOrganizations []IOrganization
@@ -39,6 +53,10 @@ func (d Department) Count() int {
 	return c
 }
 
+func (d Department) Accept(v IVisitor) {
+	v.VisitDepartment(d)
+}
+
 func (d *Department) AddSub(org IOrganization) {
 	d.SubOrganizations = append(d.SubOrganizations, org)
 }